@@ -0,0 +1,194 @@
+package goalpinejshandler
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type (
+	// ActionContext carries everything an action can work with.
+	ActionContext struct {
+		Message     Message
+		Response    http.ResponseWriter
+		Request     *http.Request
+		MessagePool *MessagePool
+		Tools       *Tools
+		// Result is sent back to the calling client in the payload of the response.
+		Result any
+	}
+	// Handler is a stateful ActionHandler with a typed payload and state. The payload is decoded
+	// before the action runs; a payload that does not fit P is answered with status 400.
+	// New states are the zero value of S; embed Handler and override NewState and
+	// GetDefaultState for other initial states.
+	Handler[P, S any] struct {
+		name    string
+		handle  func(ctx *ActionContext, payload P, state *S)
+		actions map[string]Action
+	}
+	// Action is a named action of a store. It is sent with the action type "[store] name" and
+	// the JS store gets a method with its name.
+	Action struct {
+		decode func(msg Message) (any, error)
+		handle func(ctx *ActionContext, payload any, state any) (any, error)
+	}
+	// payloadDecoder is an ActionHandler that decodes the payload of its messages before they are handled.
+	payloadDecoder interface {
+		DecodePayload(msg Message) (any, error)
+	}
+	// StatusError is an error that is answered with its status code instead of 500.
+	// Any error with a StatusCode method is answered the same way.
+	StatusError struct {
+		Code int
+		Err  error
+	}
+)
+
+// NewHandler creates a Handler for the store name. The action type of the handler is "[name] action".
+func NewHandler[P, S any](name string, handle func(ctx *ActionContext, payload P, state *S)) *Handler[P, S] {
+	return &Handler[P, S]{
+		name:    name,
+		handle:  handle,
+		actions: make(map[string]Action),
+	}
+}
+
+// NewStore creates a Handler for the store name that only has named actions.
+func NewStore[S any](name string) *Handler[any, S] {
+	return NewHandler[any, S](name, nil)
+}
+
+// NewAction creates an Action with a typed payload. S must be the state type of the store.
+func NewAction[P, S any](handle func(ctx *ActionContext, payload P, state *S)) Action {
+	return NewResultAction(func(ctx *ActionContext, payload P, state *S) (any, error) {
+		handle(ctx, payload, state)
+		return nil, nil
+	})
+}
+
+// NewResultAction creates an Action that returns a result or an error to the calling client.
+// The state is neither changed nor saved when the action fails.
+func NewResultAction[P, S, R any](handle func(ctx *ActionContext, payload P, state *S) (R, error)) Action {
+	return Action{
+		decode: func(msg Message) (any, error) {
+			return decodePayload[P](msg)
+		},
+		handle: func(ctx *ActionContext, payload any, state any) (any, error) {
+			p, ok := payload.(P)
+			if !ok {
+				return nil, fmt.Errorf("payload of %s is %T", ctx.Message.Type, payload)
+			}
+			s, ok := state.(*S)
+			if !ok {
+				return nil, fmt.Errorf("state of %s is %T", ctx.Message.Type, state)
+			}
+			return handle(ctx, p, s)
+		},
+	}
+}
+
+// NewStatusError creates an error that is answered with the status code.
+func NewStatusError(code int, err error) *StatusError {
+	return &StatusError{
+		Code: code,
+		Err:  err,
+	}
+}
+
+func (ctx *ActionContext) ClientID() string {
+	return ctx.Tools.GetClientId(ctx.Request)
+}
+
+// Value returns the value of the key in the context of the request.
+func (ctx *ActionContext) Value(key any) any {
+	return ctx.Request.Context().Value(key)
+}
+
+func (ctx *Handler[P, S]) GetName() string {
+	return ctx.name
+}
+
+func (ctx *Handler[P, S]) GetActionType() string {
+	return fmt.Sprintf("[%s] action", ctx.name)
+}
+
+func (ctx *Handler[P, S]) NewState() any {
+	return new(S)
+}
+
+func (ctx *Handler[P, S]) GetDefaultState() any {
+	return ctx.NewState()
+}
+
+// Action adds a named action to the store.
+func (ctx *Handler[P, S]) Action(name string, action Action) *Handler[P, S] {
+	ctx.actions[name] = action
+	return ctx
+}
+
+func (ctx *Handler[P, S]) Actions() map[string]Action {
+	return ctx.actions
+}
+
+// DecodePayload decodes the payload of the request body into P.
+func (ctx *Handler[P, S]) DecodePayload(msg Message) (any, error) {
+	return decodePayload[P](msg)
+}
+
+func (ctx *Handler[P, S]) Handle(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools) {
+	if ctx.handle == nil {
+		return
+	}
+	payload, ok := msg.Payload.(P)
+	if !ok {
+		return
+	}
+	state, ok := tools.State().(*S)
+	if !ok {
+		return
+	}
+	ctx.handle(newActionContext(msg, res, req, messagePool, tools), payload, state)
+}
+
+func (ctx Action) DecodePayload(msg Message) (any, error) {
+	return ctx.decode(msg)
+}
+
+func (ctx Action) run(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools) (any, error) {
+	return ctx.handle(newActionContext(msg, res, req, messagePool, tools), msg.Payload, tools.State())
+}
+
+func newActionContext(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools) *ActionContext {
+	return &ActionContext{
+		Message:     msg,
+		Response:    res,
+		Request:     req,
+		MessagePool: messagePool,
+		Tools:       tools,
+	}
+}
+
+// decodePayload decodes the payload of the message into P.
+func decodePayload[P any](msg Message) (P, error) {
+	var payload P
+	err := msg.DecodePayload(&payload)
+	if err != nil {
+		return payload, NewStatusError(http.StatusBadRequest, fmt.Errorf("invalid payload for %s: %w", msg.Type, err))
+	}
+	return payload, nil
+}
+
+func namedActionType(store, action string) string {
+	return fmt.Sprintf("[%s] %s", store, action)
+}
+
+func (ctx *StatusError) Error() string {
+	return ctx.Err.Error()
+}
+
+func (ctx *StatusError) Unwrap() error {
+	return ctx.Err
+}
+
+func (ctx *StatusError) StatusCode() int {
+	return ctx.Code
+}
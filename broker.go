@@ -0,0 +1,63 @@
+package goalpinejshandler
+
+import (
+	"slices"
+	"sync"
+)
+
+type (
+	// Broker distributes published messages to every instance that subscribed to it,
+	// including the publishing instance itself.
+	Broker interface {
+		Publish(data []byte) error
+		Subscribe(receive func(data []byte)) error
+		Close() error
+	}
+	MemoryBroker struct {
+		m         *sync.Mutex
+		receivers []func(data []byte)
+	}
+	// brokerEnvelope carries a message for a Target or, with Room set, a change of the room members
+	// published by the instance with the Origin ID.
+	brokerEnvelope struct {
+		Target  Target      `json:"target"`
+		Message Message     `json:"message"`
+		Store   string      `json:"store,omitempty"`
+		Room    *roomChange `json:"room,omitempty"`
+		Origin  string      `json:"origin,omitempty"`
+	}
+)
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		m:         &sync.Mutex{},
+		receivers: make([]func(data []byte), 0),
+	}
+}
+
+func (ctx *MemoryBroker) Publish(data []byte) error {
+	ctx.m.Lock()
+	receivers := slices.Clone(ctx.receivers)
+	ctx.m.Unlock()
+
+	for _, receive := range receivers {
+		receive(data)
+	}
+	return nil
+}
+
+func (ctx *MemoryBroker) Subscribe(receive func(data []byte)) error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	ctx.receivers = append(ctx.receivers, receive)
+	return nil
+}
+
+func (ctx *MemoryBroker) Close() error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	ctx.receivers = make([]func(data []byte), 0)
+	return nil
+}
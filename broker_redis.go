@@ -0,0 +1,218 @@
+package goalpinejshandler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisBroker publishes messages over Redis pub/sub. It speaks the plain RESP protocol,
+// so it works with every server that implements PUBLISH and SUBSCRIBE.
+// Connecting and publishing fail after the timeout, so a stalled server can not block actions.
+type RedisBroker struct {
+	m                 *sync.Mutex
+	address           string
+	channel           string
+	reconnectInterval time.Duration
+	timeout           time.Duration
+	publisher         net.Conn
+	publisherReader   *bufio.Reader
+	subscriber        net.Conn
+	closed            bool
+}
+
+func NewRedisBroker(address, channel string) *RedisBroker {
+	return &RedisBroker{
+		m:                 &sync.Mutex{},
+		address:           address,
+		channel:           channel,
+		reconnectInterval: time.Second,
+		timeout:           2 * time.Second,
+	}
+}
+
+func (ctx *RedisBroker) Publish(data []byte) error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	if ctx.closed {
+		return errors.New("redis broker is closed")
+	}
+	if ctx.publisher == nil {
+		conn, err := net.DialTimeout("tcp", ctx.address, ctx.timeout)
+		if err != nil {
+			return err
+		}
+		ctx.publisher = conn
+		ctx.publisherReader = bufio.NewReader(conn)
+	}
+	err := ctx.publisher.SetDeadline(time.Now().Add(ctx.timeout))
+	if err == nil {
+		_, err = ctx.publisher.Write(encodeRedisCommand("PUBLISH", ctx.channel, string(data)))
+	}
+	if err == nil {
+		_, err = readRedisValue(ctx.publisherReader)
+	}
+	if err != nil {
+		_ = ctx.publisher.Close()
+		ctx.publisher = nil
+		ctx.publisherReader = nil
+		return err
+	}
+	return nil
+}
+
+// Subscribe listens on the channel in the background and reconnects after connection errors
+// until the broker is closed.
+func (ctx *RedisBroker) Subscribe(receive func(data []byte)) error {
+	conn, err := ctx.subscribe()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			err := listenRedis(conn, receive)
+			if ctx.isClosed() {
+				return
+			}
+			println(fmt.Sprintf("redis subscription lost: %s", err.Error()))
+			for {
+				time.Sleep(ctx.reconnectInterval)
+				if ctx.isClosed() {
+					return
+				}
+				conn, err = ctx.subscribe()
+				if err == nil {
+					break
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (ctx *RedisBroker) Close() error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	ctx.closed = true
+	var err error
+	if ctx.publisher != nil {
+		err = ctx.publisher.Close()
+		ctx.publisher = nil
+		ctx.publisherReader = nil
+	}
+	if ctx.subscriber != nil {
+		err = errors.Join(err, ctx.subscriber.Close())
+		ctx.subscriber = nil
+	}
+	return err
+}
+
+func (ctx *RedisBroker) subscribe() (net.Conn, error) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	if ctx.closed {
+		return nil, errors.New("redis broker is closed")
+	}
+	conn, err := net.DialTimeout("tcp", ctx.address, ctx.timeout)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetWriteDeadline(time.Now().Add(ctx.timeout))
+	if err == nil {
+		_, err = conn.Write(encodeRedisCommand("SUBSCRIBE", ctx.channel))
+	}
+	if err == nil {
+		err = conn.SetWriteDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	ctx.subscriber = conn
+	return conn, nil
+}
+
+func (ctx *RedisBroker) isClosed() bool {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	return ctx.closed
+}
+
+func listenRedis(conn net.Conn, receive func(data []byte)) error {
+	reader := bufio.NewReader(conn)
+	for {
+		value, err := readRedisValue(reader)
+		if err != nil {
+			return err
+		}
+		push, ok := value.([]any)
+		if !ok || len(push) != 3 || push[0] != "message" {
+			continue
+		}
+		data, ok := push[2].(string)
+		if ok {
+			receive([]byte(data))
+		}
+	}
+}
+
+func encodeRedisCommand(args ...string) []byte {
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(command)
+}
+
+func readRedisValue(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		values := make([]any, size)
+		for i := range values {
+			values[i], err = readRedisValue(reader)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown redis reply %q", line)
+}
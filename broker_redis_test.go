@@ -0,0 +1,133 @@
+package goalpinejshandler
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a local stand-in that implements SUBSCRIBE and PUBLISH of the RESP protocol.
+type fakeRedis struct {
+	m           *sync.Mutex
+	listener    net.Listener
+	subscribers map[string][]net.Conn
+	silent      bool
+}
+
+func newFakeRedis(t *testing.T, silent bool) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeRedis{
+		m:           &sync.Mutex{},
+		listener:    listener,
+		subscribers: make(map[string][]net.Conn),
+		silent:      silent,
+	}
+	go server.accept()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return server
+}
+
+func (ctx *fakeRedis) accept() {
+	for {
+		conn, err := ctx.listener.Accept()
+		if err != nil {
+			return
+		}
+		go ctx.serve(conn)
+	}
+}
+
+func (ctx *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		value, err := readRedisValue(reader)
+		if err != nil {
+			return
+		}
+		if ctx.silent {
+			continue
+		}
+		command, ok := value.([]any)
+		if !ok || len(command) < 2 {
+			continue
+		}
+		channel := command[1].(string)
+		switch command[0] {
+		case "SUBSCRIBE":
+			ctx.m.Lock()
+			ctx.subscribers[channel] = append(ctx.subscribers[channel], conn)
+			ctx.m.Unlock()
+			_, _ = conn.Write(encodeRedisCommand("subscribe", channel, "1"))
+		case "PUBLISH":
+			ctx.m.Lock()
+			subscribers := ctx.subscribers[channel]
+			for _, subscriber := range subscribers {
+				_, _ = subscriber.Write(encodeRedisCommand("message", channel, command[2].(string)))
+			}
+			ctx.m.Unlock()
+			_, _ = conn.Write([]byte(":" + strconv.Itoa(len(subscribers)) + "\r\n"))
+		}
+	}
+}
+
+func TestRedisBrokerDeliversPublishedMessages(t *testing.T) {
+	server := newFakeRedis(t, false)
+	broker := NewRedisBroker(server.listener.Addr().String(), "alpinejs")
+	defer broker.Close()
+
+	received := make(chan string, 1)
+	err := broker.Subscribe(func(data []byte) {
+		received <- string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the subscription is registered asynchronously by the server
+	deadline := time.Now().Add(time.Second)
+	for {
+		server.m.Lock()
+		subscribed := len(server.subscribers["alpinejs"]) > 0
+		server.m.Unlock()
+		if subscribed || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	err = broker.Publish([]byte(`{"message":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-received:
+		if data != `{"message":"hello"}` {
+			t.Fatalf("unexpected message %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("published message was not received")
+	}
+}
+
+func TestRedisBrokerPublishTimesOut(t *testing.T) {
+	server := newFakeRedis(t, true)
+	broker := NewRedisBroker(server.listener.Addr().String(), "alpinejs")
+	broker.timeout = 50 * time.Millisecond
+	defer broker.Close()
+
+	start := time.Now()
+	err := broker.Publish([]byte("hello"))
+	if err == nil {
+		t.Fatal("publish to a silent server did not fail")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("publish took %s", time.Since(start))
+	}
+}
@@ -1,6 +1,12 @@
 package counter
 
-type history struct {
-	ID      int    `json:"id"`
-	Counter string `json:"counter"`
-}
+type (
+	history struct {
+		ID      int    `json:"id"`
+		Counter string `json:"counter"`
+	}
+	state struct {
+		Value   int       `json:"value"`
+		History []history `json:"history"`
+	}
+)
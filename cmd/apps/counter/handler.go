@@ -1,77 +1,68 @@
 package counter
 
 import (
-	"encoding/json"
 	"fmt"
 	goalpinejshandler "github.com/nodejayes/go-alpinejs-handler"
 	"net/http"
 )
 
-type (
-	handler struct {
-		Value   int       `json:"value"`
-		History []history `json:"history"`
-	}
-	handlerArguments struct {
-		Operation string `json:"operation"`
-		Value     int    `json:"value"`
-	}
-)
-
-func (ctx *handler) GetName() string {
-	return "counter"
+type handler struct {
+	*goalpinejshandler.Handler[any, state]
 }
 
-func (ctx *handler) GetActionType() string {
-	return fmt.Sprintf("[%s] operation", ctx.GetName())
+func newHandler() *handler {
+	return &handler{
+		Handler: goalpinejshandler.NewStore[state]("counter").
+			Action("add", goalpinejshandler.NewAction(add)).
+			Action("sub", goalpinejshandler.NewResultAction(sub)),
+	}
 }
 
 func (ctx *handler) Authorized(msg goalpinejshandler.Message, res http.ResponseWriter, req *http.Request, messagePool *goalpinejshandler.MessagePool, tools *goalpinejshandler.Tools) error {
 	return nil
 }
 
-func (ctx *handler) OnDestroy(clientID string) {
+func (ctx *handler) OnDestroy(clientID string, tools *goalpinejshandler.Tools) {
 	println(fmt.Sprintf("clientID: %s disconnected clear up something here", clientID))
-	ctx.Value = 0
-	ctx.History = make([]history, 0)
+}
+
+func (ctx *handler) NewState() any {
+	return &state{
+		Value:   0,
+		History: make([]history, 0),
+	}
 }
 
 func (ctx *handler) GetDefaultState() any {
-	return ctx
+	return ctx.NewState()
 }
 
-func (ctx *handler) Handle(msg goalpinejshandler.Message, res http.ResponseWriter, req *http.Request, messagePool *goalpinejshandler.MessagePool, tools *goalpinejshandler.Tools) {
-	content, err := json.Marshal(msg.Payload)
-	if err != nil {
-		return
+func (ctx *handler) HistoryLimit() int {
+	return 20
+}
+
+func add(ctx *goalpinejshandler.ActionContext, value int, s *state) {
+	s.History = append(s.History, history{
+		ID:      len(s.History) + 1,
+		Counter: fmt.Sprintf("Counter %v", s.Value),
+	})
+	s.Value += value
+}
+
+func sub(ctx *goalpinejshandler.ActionContext, value int, s *state) (int, error) {
+	if s.Value < value {
+		return s.Value, goalpinejshandler.NewStatusError(http.StatusUnprocessableEntity, fmt.Errorf("counter can not go below zero"))
 	}
-	var args handlerArguments
-	err = json.Unmarshal(content, &args)
-	if err != nil {
-		return
+	if len(s.History) > 0 {
+		s.History = s.History[:len(s.History)-1]
 	}
+	s.Value -= value
+	return s.Value, nil
+}
 
-	switch args.Operation {
-	case "add":
-		ctx.History = append(ctx.History, history{
-			ID:      len(ctx.History) + 1,
-			Counter: fmt.Sprintf("Counter %v", ctx.Value),
-		})
-		ctx.Value += args.Value
-	case "sub":
-		if ctx.Value > 0 {
-			ctx.History = ctx.History[:len(ctx.History)-1]
-			ctx.Value -= args.Value
-		}
+func summary(inputs map[string]any) any {
+	s := inputs["counter"].(*state)
+	return map[string]string{
+		"label": fmt.Sprintf("%v steps, current value %v", len(s.History), s.Value),
 	}
-
-	messagePool.Add(goalpinejshandler.ChannelMessage{
-		ClientFilter: func(client goalpinejshandler.Client) bool {
-			return true
-		},
-		Message: goalpinejshandler.Message{
-			Type:    fmt.Sprintf("[%s] update", ctx.GetName()),
-			Payload: ctx,
-		},
-	})
 }
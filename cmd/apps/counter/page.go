@@ -46,10 +46,8 @@ func (ctx *Page) Route() string {
 
 func (ctx *Page) Handlers() []goalpinejshandler.ActionHandler {
 	return []goalpinejshandler.ActionHandler{
-		&handler{
-			Value:   0,
-			History: make([]history, 0),
-		},
+		newHandler(),
+		goalpinejshandler.NewDerivedStore("counterSummary", goalpinejshandler.ScopeClient, []string{"counter"}, summary),
 	}
 }
 
@@ -67,7 +65,7 @@ func (ctx *Page) Render() string {
 			</head>
 			<body>
 				<h1>Überflieger</h1>
-				<div x-data="$store.counter.state" x-init="$store.counter.emit({operation:'get'})">
+				<div x-data="$store.counter.state">
 					<span x-text="value"></span>
 					<ul>
 						<template x-for="hist in history">
@@ -78,8 +76,12 @@ func (ctx *Page) Render() string {
 						</template>
 					</ul>
 				</div>
-				<button x-data @click="$store.counter.emit({operation:'add',value:1})">+</button>
-				<button x-data @click="$store.counter.emit({operation:'sub',value:1})">-</button>
+				<p x-data x-text="$store.counterSummary.state.label"></p>
+				<button x-data @click="$store.counter.add(1)">+</button>
+				<button x-data :disabled="$store.counter.pending.sub" @click="$store.counter.sub(1)">-</button>
+				<p x-data x-show="$store.counter.lastError.sub" x-text="$store.counter.lastError.sub?.error"></p>
+				<button x-data :disabled="!$store.counter.canUndo" @click="$store.counter.undo()">Undo</button>
+				<button x-data :disabled="!$store.counter.canRedo" @click="$store.counter.redo()">Redo</button>
 				{{ .Paint .CustomButton1 }}
 				{{ .Paint .CustomButton2 }}
 			</body>
@@ -14,11 +14,18 @@ func main() {
 		ActionUrl:         "/action",
 		EventUrl:          "/events",
 		ClientIDHeaderKey: "clientId",
+		Middleware: []goalpinejshandler.Middleware{
+			goalpinejshandler.Recover(),
+			goalpinejshandler.Logging(),
+		},
 		Pages: []goalpinejshandler.Page{
 			counter.NewPage(),
 		},
 	}
-	goalpinejshandler.Register(router, &config)
+	err := goalpinejshandler.Register(router, &config)
+	if err != nil {
+		panic(err)
+	}
 
 	http.ListenAndServe(":40000", router)
 }
@@ -1,13 +1,66 @@
 package goalpinejshandler
 
+import "encoding/json"
+
 type (
 	Message struct {
-		Type    string `json:"type"`
-		Payload any    `json:"payload"`
+		Type          string `json:"type"`
+		Payload       any    `json:"payload"`
+		CorrelationID string `json:"correlationId,omitempty"`
+		Version       uint64 `json:"version,omitempty"`
+		raw           json.RawMessage
 	}
 
 	Response struct {
-		Code  int    `json:"code"`
-		Error string `json:"error"`
+		Code          int    `json:"code"`
+		Error         string `json:"error"`
+		CorrelationID string `json:"correlationId,omitempty"`
+		Updates       int    `json:"updates,omitempty"`
+		Version       uint64 `json:"version,omitempty"`
+		Payload       any    `json:"payload,omitempty"`
 	}
 )
+
+// UnmarshalJSON keeps the payload raw, so typed handlers decode it straight into their payload
+// type. The Payload field stays nil until decodePayload fills it for everyone else, before that
+// DecodePayload reads it.
+func (ctx *Message) UnmarshalJSON(data []byte) error {
+	type message Message
+	var decoded struct {
+		message
+		Payload json.RawMessage `json:"payload"`
+	}
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return err
+	}
+	*ctx = Message(decoded.message)
+	ctx.raw = decoded.Payload
+	return nil
+}
+
+// decodePayload fills Payload from the raw payload of a decoded message.
+func (ctx *Message) decodePayload() error {
+	if ctx.Payload != nil || len(ctx.raw) < 1 {
+		return nil
+	}
+	return json.Unmarshal(ctx.raw, &ctx.Payload)
+}
+
+// DecodePayload decodes the payload into v. Middleware reads the payload of messages from a client
+// with it, their Payload is filled when the action runs. Messages created on the server are
+// converted from their Payload.
+func (ctx Message) DecodePayload(v any) error {
+	raw := ctx.raw
+	if len(raw) < 1 {
+		if ctx.Payload == nil {
+			return nil
+		}
+		var err error
+		raw, err = json.Marshal(ctx.Payload)
+		if err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(raw, v)
+}
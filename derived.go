@@ -0,0 +1,128 @@
+package goalpinejshandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	di "github.com/nodejayes/generic-di"
+)
+
+// DerivedStore is a store whose state is computed on the server from the states of other stores.
+// Add it to Page.Handlers like any other handler; it is recomputed and sent with the usual
+// update message whenever one of its input stores changes. The compute function receives
+// copies of the input states keyed by store name. All inputs must have the scope of the
+// derived store.
+type DerivedStore struct {
+	name    string
+	scope   Scope
+	inputs  []string
+	compute func(inputs map[string]any) any
+}
+
+func NewDerivedStore(name string, scope Scope, inputs []string, compute func(inputs map[string]any) any) *DerivedStore {
+	return &DerivedStore{
+		name:    name,
+		scope:   scope,
+		inputs:  inputs,
+		compute: compute,
+	}
+}
+
+func (ctx *DerivedStore) GetName() string {
+	return ctx.name
+}
+
+func (ctx *DerivedStore) GetActionType() string {
+	return fmt.Sprintf("[%s] derived", ctx.name)
+}
+
+func (ctx *DerivedStore) Scope() Scope {
+	return ctx.scope
+}
+
+// GetDefaultState computes the state from the default states of the inputs.
+func (ctx *DerivedStore) GetDefaultState() any {
+	inputs := make(map[string]any)
+	for _, name := range ctx.inputs {
+		input := actionProcessor.stores[name]
+		if input != nil {
+			inputs[name] = input.NewState()
+		}
+	}
+	return ctx.compute(inputs)
+}
+
+// Authorized rejects every action, a derived store only changes through its inputs.
+func (ctx *DerivedStore) Authorized(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools) error {
+	return fmt.Errorf("store %s is derived and has no actions", ctx.name)
+}
+
+func (ctx *DerivedStore) Handle(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools) {
+}
+
+func (ctx *DerivedStore) dependsOn(name string) bool {
+	return slices.Contains(ctx.inputs, name)
+}
+
+// recompute calculates the state for the scope of the request and sends it.
+func (ctx *DerivedStore) recompute(stores map[string]statefulHandler, tools *Tools, req *http.Request, messagePool *MessagePool) error {
+	_, target, err := stateKey(handlerScope(ctx), tools, req)
+	if err != nil {
+		return err
+	}
+	state, err := ctx.state(stores, tools, req)
+	if err != nil {
+		return err
+	}
+	messagePool.Add(ChannelMessage{
+		Target: target,
+		Message: Message{
+			Type:    updateType(ctx.name),
+			Payload: state,
+		},
+		store: ctx.name,
+	})
+	return nil
+}
+
+// state computes the state from the input states of the request.
+func (ctx *DerivedStore) state(stores map[string]statefulHandler, tools *Tools, req *http.Request) (any, error) {
+	states := di.Inject[stateManager]()
+	inputs := make(map[string]any)
+	for _, name := range ctx.inputs {
+		input := stores[name]
+		if input == nil {
+			return nil, fmt.Errorf("input store %s of derived store %s not found", name, ctx.name)
+		}
+		key, _, err := stateKey(handlerScope(input), tools, req)
+		if err != nil {
+			return nil, err
+		}
+		inputs[name], err = copyState(input, states.Get(input, key))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ctx.compute(inputs), nil
+}
+
+// copyState returns a copy of the state of the entry so it can be read without holding its lock.
+func copyState(handler statefulHandler, entry *stateEntry) (any, error) {
+	entry.m.Lock()
+	defer entry.m.Unlock()
+
+	return cloneState(handler, entry.state)
+}
+
+// cloneState returns a deep copy of the state created with NewState.
+func cloneState(handler statefulHandler, state any) (any, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	clone := handler.NewState()
+	err = json.Unmarshal(data, clone)
+	return clone, err
+}
@@ -4,5 +4,6 @@ go 1.22.0
 
 require (
 	github.com/google/uuid v1.6.0
+	github.com/gorilla/websocket v1.5.3
 	github.com/nodejayes/generic-di v1.2.3
-)
\ No newline at end of file
+)
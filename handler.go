@@ -1,14 +1,28 @@
 package goalpinejshandler
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+
+	di "github.com/nodejayes/generic-di"
 )
 
+// handleFunc runs an action and returns the result for the calling client.
+type handleFunc func(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools) (any, error)
+
 type processor struct {
 	tools       *Tools
 	protectors  map[string]func(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools) error
-	handlers    map[string]func(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools)
+	handlers    map[string]handleFunc
+	stateful    map[string]statefulHandler
+	stores      map[string]statefulHandler
+	history     map[string]statefulHandler
+	decoders    map[string]payloadDecoder
+	middleware  []Middleware
+	chains      map[string][]Middleware
+	derived     []*DerivedStore
 	messagePool *MessagePool
 }
 
@@ -16,26 +30,221 @@ func (ctx *processor) registerTools(tools *Tools) {
 	ctx.tools = tools
 }
 
-func (ctx *processor) dispatch(message Message, res http.ResponseWriter, req *http.Request) error {
+func (ctx *processor) registerMiddleware(middleware []Middleware) {
+	ctx.middleware = middleware
+}
+
+// dispatch runs the handler of the message and builds the response for the calling client.
+// Messages the handler adds to the MessagePool carry the CorrelationID of the action.
+func (ctx *processor) dispatch(message Message, res http.ResponseWriter, req *http.Request) Response {
+	clientID := ctx.tools.GetClientId(req)
+	if clientID != "" {
+		di.Inject[clientTracker]().Touch(clientID)
+	}
+	messagePool := ctx.messagePool.correlate(message.CorrelationID, Client{
+		ID:           clientID,
+		ConnectionID: ctx.tools.GetConnectionId(req),
+		UserID:       ctx.tools.GetUserId(req),
+	})
+	action := newActionContext(message, res, req, messagePool, ctx.tools)
+	err := chain(func(action *ActionContext) error {
+		var err error
+		action.Result, err = ctx.run(action.Message, action.Response, action.Request, action.MessagePool)
+		return err
+	}, ctx.middleware, ctx.chains[message.Type])(action)
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		return Response{
+			Code:          http.StatusConflict,
+			Error:         err.Error(),
+			CorrelationID: message.CorrelationID,
+			Version:       conflict.Current,
+		}
+	}
+	var status interface{ StatusCode() int }
+	if errors.As(err, &status) {
+		return Response{
+			Code:          status.StatusCode(),
+			Error:         err.Error(),
+			CorrelationID: message.CorrelationID,
+		}
+	}
+	if err != nil {
+		return Response{
+			Code:          http.StatusInternalServerError,
+			Error:         err.Error(),
+			CorrelationID: message.CorrelationID,
+		}
+	}
+	return Response{
+		Code:          http.StatusOK,
+		Error:         "",
+		CorrelationID: message.CorrelationID,
+		Updates:       messagePool.correlated(),
+		Payload:       action.Result,
+	}
+}
+
+func (ctx *processor) run(message Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool) (any, error) {
+	historic := ctx.history[message.Type]
+	if historic != nil {
+		protector := ctx.protectors[historic.GetActionType()]
+		if protector != nil {
+			err := protector(message, res, req, messagePool, ctx.tools)
+			if err != nil {
+				return nil, err
+			}
+		}
+		changed, err := ctx.handleHistory(historic, message, req, messagePool)
+		if err != nil || !changed {
+			return nil, err
+		}
+		ctx.recompute(historic.GetName(), req, messagePool)
+		return nil, nil
+	}
 	handler := ctx.handlers[message.Type]
 	protector := ctx.protectors[message.Type]
 	if handler != nil {
+		decoder := ctx.decoders[message.Type]
+		if decoder != nil {
+			payload, err := decoder.DecodePayload(message)
+			if err != nil {
+				return nil, err
+			}
+			message.Payload = payload
+		} else {
+			err := message.decodePayload()
+			if err != nil {
+				return nil, NewStatusError(http.StatusBadRequest, err)
+			}
+		}
 		if protector != nil {
-			err := protector(message, res, req, ctx.messagePool, ctx.tools)
+			err := protector(message, res, req, messagePool, ctx.tools)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
-		handler(message, res, req, ctx.messagePool, ctx.tools)
+		stateful := ctx.stateful[message.Type]
+		if stateful != nil {
+			result, err := ctx.handleState(stateful, handler, message, res, req, messagePool)
+			if err != nil {
+				return nil, err
+			}
+			ctx.recompute(stateful.GetName(), req, messagePool)
+			return result, nil
+		}
+		return handler(message, res, req, messagePool, ctx.tools)
+	}
+	return nil, fmt.Errorf("handler %s not found", message.Type)
+}
+
+// handleState runs the handler with the state of its scope and sends the changed state to
+// every connection in that scope. Handlers that reject stale actions return a
+// ConflictError when the action was based on another version than the current one.
+// The handler runs on a copy of the state, which replaces the state only when the action
+// succeeds, so a failed or panicking action leaves the state as it was.
+func (ctx *processor) handleState(handler statefulHandler, handle handleFunc, message Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool) (any, error) {
+	key, target, err := stateKey(handlerScope(handler), ctx.tools, req)
+	if err != nil {
+		return nil, err
+	}
+	states := di.Inject[stateManager]()
+	entry := states.Get(handler, key)
+	entry.m.Lock()
+	defer entry.m.Unlock()
+
+	err = rejectStale(handler, message, entry, target, messagePool)
+	if err != nil {
+		return nil, err
+	}
+	state, err := cloneState(handler, entry.state)
+	if err != nil {
+		return nil, err
+	}
+	result, err := handle(message, res, req, messagePool, ctx.tools.withState(state))
+	if err != nil {
+		return nil, err
+	}
+	limit := historyLimit(handler)
+	if limit > 0 {
+		entry.record(entry.state, limit)
+	}
+	entry.state = state
+	entry.version++
+	states.Save(handler, key, entry)
+	sendState(messagePool, handler, target, entry)
+	if limit > 0 {
+		sendHistory(messagePool, handler, target, entry)
+	}
+	return result, nil
+}
+
+// rejectStale returns a ConflictError and sends the current state when the handler rejects stale
+// actions and the action was based on another version. The caller holds the lock of the entry.
+func rejectStale(handler statefulHandler, message Message, entry *stateEntry, target *Target, messagePool *MessagePool) error {
+	vh, ok := handler.(versionCheckedHandler)
+	if !ok || !vh.RejectStaleActions() || message.Version == entry.version {
 		return nil
 	}
-	return fmt.Errorf("handler %s not found", message.Type)
+	sendState(messagePool, handler, target, entry)
+	return &ConflictError{
+		Store:   handler.GetName(),
+		Version: message.Version,
+		Current: entry.version,
+	}
+}
+
+// recompute sends the derived stores that depend on the changed store. The action already
+// changed and sent its state, so errors are only logged.
+func (ctx *processor) recompute(name string, req *http.Request, messagePool *MessagePool) {
+	for _, derived := range ctx.derived {
+		if !derived.dependsOn(name) {
+			continue
+		}
+		err := derived.recompute(ctx.stores, ctx.tools, req, messagePool)
+		if err != nil {
+			println(fmt.Sprintf("error on recompute derived store %s: %s", derived.GetName(), err.Error()))
+		}
+	}
+}
+
+// sendState sends the state of the entry with its version to the target.
+// The caller holds the lock of the entry.
+func sendState(messagePool *MessagePool, handler statefulHandler, target *Target, entry *stateEntry) {
+	messagePool.Add(ChannelMessage{
+		Target: target,
+		Message: Message{
+			Type:    updateType(handler.GetName()),
+			Payload: entry.state,
+			Version: entry.version,
+		},
+		store: handler.GetName(),
+	})
 }
 
 func (ctx *processor) registerHandlers(handlers []ActionHandler, messagePool *MessagePool) {
 	ctx.messagePool = messagePool
 	for _, handler := range handlers {
-		ctx.handlers[handler.GetActionType()] = handler.Handle
+		ctx.handlers[handler.GetActionType()] = actionHandleFunc(handler)
+		sh, ok := handler.(statefulHandler)
+		if ok {
+			ctx.stateful[sh.GetActionType()] = sh
+			ctx.stores[sh.GetName()] = sh
+			if historyLimit(sh) > 0 {
+				ctx.history[undoType(sh.GetName())] = sh
+				ctx.history[redoType(sh.GetName())] = sh
+			}
+			ctx.registerActions(sh)
+		}
+		ctx.registerHandlerMiddleware(handler)
+		derived, ok := handler.(*DerivedStore)
+		if ok && !slices.Contains(ctx.derived, derived) {
+			ctx.derived = append(ctx.derived, derived)
+		}
+		decoder, ok := handler.(payloadDecoder)
+		if ok {
+			ctx.decoders[handler.GetActionType()] = decoder
+		}
 		protectedHandler, ok := handler.(protectedActionHandler)
 		if ok {
 			ctx.protectors[protectedHandler.GetActionType()] = protectedHandler.Authorized
@@ -43,7 +252,65 @@ func (ctx *processor) registerHandlers(handlers []ActionHandler, messagePool *Me
 	}
 }
 
+// actionHandleFunc returns HandleResult of the handler, or Handle without a result.
+func actionHandleFunc(handler ActionHandler) handleFunc {
+	rh, ok := handler.(resultHandler)
+	if ok {
+		return rh.HandleResult
+	}
+	return func(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools) (any, error) {
+		handler.Handle(msg, res, req, messagePool, tools)
+		return nil, nil
+	}
+}
+
+// registerActions routes the named actions of the store by "[store] name" to their Action.
+// They share the state, protector and history of the store.
+func (ctx *processor) registerActions(handler statefulHandler) {
+	ah, ok := handler.(actionsHandler)
+	if !ok {
+		return
+	}
+	protectedHandler, protected := handler.(protectedActionHandler)
+	for name, action := range ah.Actions() {
+		actionType := namedActionType(handler.GetName(), name)
+		ctx.handlers[actionType] = action.run
+		ctx.stateful[actionType] = handler
+		ctx.decoders[actionType] = action
+		if protected {
+			ctx.protectors[actionType] = protectedHandler.Authorized
+		}
+	}
+}
+
+// registerHandlerMiddleware wraps every action type of the handler in its Middleware.
+func (ctx *processor) registerHandlerMiddleware(handler ActionHandler) {
+	mh, ok := handler.(middlewareHandler)
+	if !ok {
+		return
+	}
+	actionTypes := []string{handler.GetActionType()}
+	if historyLimit(handler) > 0 {
+		actionTypes = append(actionTypes, undoType(handler.GetName()), redoType(handler.GetName()))
+	}
+	ah, ok := handler.(actionsHandler)
+	if ok {
+		for name := range ah.Actions() {
+			actionTypes = append(actionTypes, namedActionType(handler.GetName(), name))
+		}
+	}
+	for _, actionType := range actionTypes {
+		ctx.chains[actionType] = mh.Middleware()
+	}
+}
+
 var actionProcessor = &processor{
 	protectors: make(map[string]func(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools) error),
-	handlers:   make(map[string]func(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools)),
+	handlers:   make(map[string]handleFunc),
+	stateful:   make(map[string]statefulHandler),
+	stores:     make(map[string]statefulHandler),
+	history:    make(map[string]statefulHandler),
+	decoders:   make(map[string]payloadDecoder),
+	chains:     make(map[string][]Middleware),
+	derived:    make([]*DerivedStore, 0),
 }
@@ -0,0 +1,124 @@
+package goalpinejshandler
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	di "github.com/nodejayes/generic-di"
+)
+
+// historyInfo tells the client whether the store has states to undo or redo.
+type historyInfo struct {
+	CanUndo bool `json:"canUndo"`
+	CanRedo bool `json:"canRedo"`
+}
+
+func historyLimit(handler ActionHandler) int {
+	hh, ok := handler.(historyHandler)
+	if !ok {
+		return 0
+	}
+	return hh.HistoryLimit()
+}
+
+// record keeps the state before an action as the latest undo step, unless the action changed
+// nothing. A new step discards the redo steps. The caller holds the lock of the entry.
+func (ctx *stateEntry) record(previous any, limit int) {
+	before, err := normalizeJSON(previous)
+	if err != nil {
+		return
+	}
+	after, err := normalizeJSON(ctx.state)
+	if err == nil && reflect.DeepEqual(before, after) {
+		return
+	}
+	ctx.past = append(ctx.past, previous)
+	if len(ctx.past) > limit {
+		ctx.past = ctx.past[len(ctx.past)-limit:]
+	}
+	ctx.future = nil
+}
+
+func (ctx *stateEntry) history() historyInfo {
+	return historyInfo{
+		CanUndo: len(ctx.past) > 0,
+		CanRedo: len(ctx.future) > 0,
+	}
+}
+
+// handleHistory runs the undo or redo action of the store. The current state moves to the
+// opposite stack, so every undo can be redone until the next regular action.
+// It returns false when there was no step to apply. The history is kept in memory only and
+// starts empty after the state was unloaded.
+func (ctx *processor) handleHistory(handler statefulHandler, message Message, req *http.Request, messagePool *MessagePool) (bool, error) {
+	key, target, err := stateKey(handlerScope(handler), ctx.tools, req)
+	if err != nil {
+		return false, err
+	}
+	states := di.Inject[stateManager]()
+	entry := states.Get(handler, key)
+	entry.m.Lock()
+	defer entry.m.Unlock()
+
+	err = rejectStale(handler, message, entry, target, messagePool)
+	if err != nil {
+		return false, err
+	}
+	from, to := &entry.past, &entry.future
+	if message.Type == redoType(handler.GetName()) {
+		from, to = to, from
+	}
+	if len(*from) < 1 {
+		sendHistory(messagePool, handler, target, entry)
+		return false, nil
+	}
+	*to = append(*to, entry.state)
+	entry.state = (*from)[len(*from)-1]
+	*from = (*from)[:len(*from)-1]
+	entry.version++
+	states.Save(handler, key, entry)
+	sendState(messagePool, handler, target, entry)
+	sendHistory(messagePool, handler, target, entry)
+	return true, nil
+}
+
+// historySnapshot returns the history flags of the store in the scope of the request.
+func (ctx *processor) historySnapshot(name string, req *http.Request) (historyInfo, bool) {
+	handler := ctx.stores[name]
+	if handler == nil || historyLimit(handler) < 1 {
+		return historyInfo{}, false
+	}
+	key, _, err := stateKey(handlerScope(handler), ctx.tools, req)
+	if err != nil {
+		return historyInfo{}, false
+	}
+	entry := di.Inject[stateManager]().Get(handler, key)
+	entry.m.Lock()
+	defer entry.m.Unlock()
+
+	return entry.history(), true
+}
+
+// sendHistory sends the history flags of the entry to the target. The caller holds the lock of the entry.
+func sendHistory(messagePool *MessagePool, handler statefulHandler, target *Target, entry *stateEntry) {
+	messagePool.Add(ChannelMessage{
+		Target: target,
+		Message: Message{
+			Type:    historyType(handler.GetName()),
+			Payload: entry.history(),
+		},
+	})
+}
+
+func undoType(name string) string {
+	return fmt.Sprintf("[%s] undo", name)
+}
+
+func redoType(name string) string {
+	return fmt.Sprintf("[%s] redo", name)
+}
+
+func historyType(name string) string {
+	return fmt.Sprintf("[%s] history", name)
+}
@@ -5,6 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"net/http"
+	"slices"
+	"strings"
 )
 
 const src = `
@@ -33,6 +36,36 @@ window.alpinestorehandler.applyChanges = function (original, changes) {
 		original[key] = changes[key];
 	}
 };
+window.alpinestorehandler.applyPatch = function (original, operations) {
+	for (const operation of operations) {
+		if (operation.path === '') {
+			window.alpinestorehandler.applyChanges(original, operation.value);
+			continue;
+		}
+		const keys = operation.path.substring(1).split('/').map((key) => key.replaceAll('~1', '/').replaceAll('~0', '~'));
+		const last = keys.pop();
+		let parent = original;
+		for (const key of keys) {
+			parent = parent[key];
+		}
+		if (Array.isArray(parent)) {
+			const idx = last === '-' ? parent.length : Number(last);
+			if (operation.op === 'add') {
+				parent.splice(idx, 0, operation.value);
+			} else if (operation.op === 'remove') {
+				parent.splice(idx, 1);
+			} else if (operation.op === 'replace') {
+				parent[idx] = operation.value;
+			}
+			continue;
+		}
+		if (operation.op === 'remove') {
+			delete parent[last];
+			continue;
+		}
+		parent[last] = operation.value;
+	}
+};
 window.alpinestorehandler.eventEmitter = function() {
 	const _events = {};
 	return {
@@ -50,7 +83,7 @@ window.alpinestorehandler.eventEmitter = function() {
 				unsubscribe: () => delete _events[event][idx],
 			};
 		},
-		emit: (event, payload) => {
+		emit: (event, payload, message) => {
 			if (!_events[event]) {
 				return;
 			}
@@ -59,7 +92,7 @@ window.alpinestorehandler.eventEmitter = function() {
 				if (!ev || typeof ev !== "function") {
 					continue;
 				}
-				ev(payload ?? (null));
+				ev(payload ?? (null), message);
 			}
 		},
 	}
@@ -67,88 +100,343 @@ window.alpinestorehandler.eventEmitter = function() {
 window.alpinestorehandler.eventHandler = (function() {
 	let _config = null;
 	let _source = null;
-	const _sourceCanReconnect = true;
+	let _socket = null;
+	let _sourceCanReconnect = true;
+	let _socketActionId = 0;
+	let _lastEventId = null;
+	let _heartbeatTimer = null;
+	let _sourceFailures = 0;
+	let _sourceOpened = false;
+	let _polling = false;
+	let _pollRun = 0;
+	const _connectionId = crypto.randomUUID();
+	const _correlations = {};
+	const _socketActions = {};
+	const _socketQueue = [];
 	const _sourceMessage = new window.alpinestorehandler.eventEmitter();
 	const _readyConnection = new window.alpinestorehandler.eventEmitter();
 
+	function isPolling() {
+		return _polling || _config?.transport === 'poll';
+	}
+
+	function watchHeartbeat() {
+		clearTimeout(_heartbeatTimer);
+		if (!_config?.heartbeatInterval || isPolling()) {
+			return;
+		}
+		_heartbeatTimer = setTimeout(() => {
+			if (_config) {
+				open(_config);
+			}
+		}, _config.heartbeatInterval * 2);
+	}
+
 	function newMessage(event) {
-		const message = JSON.parse(event.data);
-		_sourceMessage.emit(message.type, message.payload);
+		handleMessage(JSON.parse(event.data), event.lastEventId);
+	}
+
+	function handleMessage(message, lastEventId) {
+		watchHeartbeat();
+		_sourceFailures = 0;
+		if (lastEventId) {
+			_lastEventId = lastEventId;
+		}
+		if (message.type === 'reply') {
+			settleSocketAction(message.payload.id, (action) => action.resolve(message.payload.response));
+			return;
+		}
+		_correlations[message.correlationId]?.(message);
+		_sourceMessage.emit(message.type, message.payload, message);
+	}
+
+	function correlate(correlationId, timeout) {
+		const messages = [];
+		let expected = null;
+		let finish = null;
+		const done = new Promise((resolve) => {
+			finish = () => {
+				clearTimeout(timer);
+				delete _correlations[correlationId];
+				resolve(messages);
+			};
+		});
+		const timer = setTimeout(() => finish(), timeout);
+		_correlations[correlationId] = (message) => {
+			messages.push(message);
+			if (expected !== null && messages.length >= expected) {
+				finish();
+			}
+		};
+		return {
+			expect: (count) => {
+				expected = count;
+				if (messages.length >= expected) {
+					finish();
+				}
+				return done;
+			},
+			cancel: () => finish(),
+		};
+	}
+
+	function postAction(message) {
+		return fetch(_config.actionUrl, {
+			mode: "cors",
+			method: "POST",
+			headers: {
+				"Content-Type": "application/json",
+				[_config.clientIdHeaderKey]: getClientId(
+					_config.clientIdHeaderKey
+				),
+				[_config.connectionIdHeaderKey]: _connectionId,
+			},
+			body: JSON.stringify(message),
+		}).then((resp) => resp.json());
 	}
 
 	function sourceError(event) {
+		// only a stream that never opened falls back to polling, errors after that are
+		// reconnects, for example while the server restarts
+		if (!_sourceOpened) {
+			_sourceFailures++;
+		}
+		if (_config && _sourceFailures >= _config.pollFallbackAfter) {
+			_polling = true;
+			open(_config);
+			return;
+		}
 		if (
 			event?.target?.readyState === EventSource.CLOSED &&
 			_sourceCanReconnect &&
 			_config
 		) {
-			setTimeout(
-				() =>
-					_config ? open(_config) : sourceError(event),
-				_config.reconnectTimeout
-			);
+			reconnect(event);
+		}
+	}
+
+	function socketClose(event, socket) {
+		for (const id of Object.keys(_socketActions)) {
+			if (_socketActions[id].socket === socket) {
+				settleSocketAction(id, (action) => action.reject(new Error('socket closed before the action was answered')));
+			}
+		}
+		if (_sourceCanReconnect && _config) {
+			reconnect(event);
 		}
 	}
 
+	function reconnect(event) {
+		setTimeout(
+			() =>
+				_config ? open(_config) : reconnect(event),
+			_config.reconnectTimeout
+		);
+	}
+
 	function sourceOpen(event) {
+		_sourceOpened = true;
+		watchHeartbeat();
 		_readyConnection.emit("ready");
 	}
 
+	function socketOpen(event) {
+		watchHeartbeat();
+		while (_socketQueue.length > 0) {
+			const queued = _socketQueue.shift();
+			if (_socketActions[queued.id]) {
+				_socketActions[queued.id].socket = _socket;
+				_socket.send(queued.frame);
+			}
+		}
+		_readyConnection.emit("ready");
+	}
+
+	function poll(run) {
+		if (run !== _pollRun) {
+			return;
+		}
+		fetch(trimUrl(_config.pollUrl) + connectionQuery(_config))
+			.then((resp) => {
+				if (!resp.ok) {
+					throw new Error('poll failed with status ' + resp.status);
+				}
+				return resp.json();
+			})
+			.then((events) => {
+				for (const event of events) {
+					handleMessage(event.message, event.id ? String(event.id) : null);
+				}
+				poll(run);
+			})
+			.catch(() => setTimeout(() => poll(run), _config.reconnectTimeout));
+	}
+
 	function getClientId(key) {
-		let clientId = localStorage.getItem(key);
+		let clientId = _config?.clientId ?? localStorage.getItem(key);
 		if (!clientId) {
 			if (!crypto || typeof crypto.randomUUID !== 'function') {
 				throw new Error('Crypto API not supported');
 			}
 			clientId = crypto.randomUUID();
+		}
+		if (localStorage.getItem(key) !== clientId) {
 			localStorage.setItem(key, clientId);
+			document.cookie = key + '=' + clientId + '; path=/; SameSite=Lax';
 		}
 		return clientId;
 	}
 
+	function connectionQuery(config) {
+		let query = '?' + config.clientIdHeaderKey + '=' + getClientId(config.clientIdHeaderKey) + '&connectionId=' + _connectionId;
+		if (config.stores?.length) {
+			query += '&stores=' + encodeURIComponent(config.stores.join(','));
+		}
+		if (_lastEventId) {
+			query += '&lastEventId=' + encodeURIComponent(_lastEventId);
+		}
+		return query;
+	}
+
+	function trimUrl(url) {
+		return url.endsWith("/")
+			? url.substring(0, url.length - 1)
+			: url;
+	}
+
+	function close() {
+		clearTimeout(_heartbeatTimer);
+		_pollRun++;
+		_sourceCanReconnect = false;
+		if (_source) {
+			_source.close();
+			_source = null;
+		}
+		if (_socket) {
+			_socket.close();
+			_socket = null;
+		}
+		_sourceCanReconnect = true;
+	}
+
+	function openSource(config) {
+		_source = new EventSource(trimUrl(config.eventUrl) + connectionQuery(config));
+		_source.onmessage = (event) =>
+			newMessage(event);
+		_source.onerror = (event) => sourceError(event);
+		_source.onopen = (event) => sourceOpen(event);
+	}
+
+	function openSocket(config) {
+		const protocol = location.protocol === 'https:' ? 'wss://' : 'ws://';
+		_socket = new WebSocket(protocol + location.host + trimUrl(config.socketUrl) + connectionQuery(config));
+		_socket.onmessage = (event) => newMessage(event);
+		const socket = _socket;
+		_socket.onclose = (event) => socketClose(event, socket);
+		_socket.onopen = (event) => socketOpen(event);
+	}
+
+	function sendSocketAction(message, timeout) {
+		return new Promise((resolve, reject) => {
+			const id = ++_socketActionId;
+			const timer = setTimeout(
+				() => settleSocketAction(id, (action) => action.reject(new Error('action ' + message.type + ' timed out'))),
+				timeout
+			);
+			_socketActions[id] = { resolve, reject, timer, socket: null };
+			const frame = JSON.stringify({ id, message });
+			if (_socket && _socket.readyState === WebSocket.OPEN) {
+				_socketActions[id].socket = _socket;
+				_socket.send(frame);
+				return;
+			}
+			_socketQueue.push({ id, frame });
+		});
+	}
+
+	function settleSocketAction(id, settle) {
+		const action = _socketActions[id];
+		if (!action) {
+			return;
+		}
+		delete _socketActions[id];
+		clearTimeout(action.timer);
+		settle(action);
+	}
+
+	function open(config) {
+		if (!config.reconnectTimeout) {
+			config.eventUrl = "/events";
+			config.actionUrl = "/action";
+			config.socketUrl = "/socket";
+			config.pollUrl = "/events/poll";
+			config.stateUrl = "/state";
+			config.stores = [];
+			config.pollFallbackAfter = 3;
+			config.transport = "sse";
+			config.clientIdHeaderKey = "clientId";
+			config.connectionIdHeaderKey = "connectionId";
+			config.reconnectTimeout = 5000;
+			config.heartbeatInterval = 15000;
+		}
+		_config = config;
+		close();
+		if (isPolling()) {
+			poll(_pollRun);
+			return;
+		}
+		if (config.transport === 'websocket') {
+			openSocket(config);
+			return;
+		}
+		openSource(config);
+	}
+
 	return {
-		open: (config) => {
-			if (!config.reconnectTimeout) {
-				config.eventUrl = "/events";
-				config.actionUrl = "/action";
-				config.clientIdHeaderKey = "clientId";
-				config.reconnectTimeout = 5000;
-			}
-			_config = config;
-			if (_source) {
-				_sourceCanReconnect = false;
-				_source.close();
-				_sourceCanReconnect = true;
-				_source = null;
-			}
-			const pre = config.eventUrl.endsWith("/")
-			? config.eventUrl.substring(0, config.eventUrl.length - 1)
-			: config.eventUrl;
-			const eventUrl = pre + '?clientId=' + getClientId(config.clientIdHeaderKey);
-			_source = new EventSource(eventUrl);
-			_source.onmessage = (event) =>
-				newMessage(event);
-			_source.onerror = (event) => sourceError(event);
-			_source.onopen = (event) => sourceOpen(event);
-		},
+		open,
 		subscribe: (event, handler) => {
 			return _sourceMessage.subscribe(event, handler);
 		},
-		sendAction: async (message) => {
+		snapshot: async (store) => {
 			if (!_config) {
 				throw new Error("no config found");
 			}
-			return await fetch(_config.actionUrl, {
-				mode: "cors",
-				method: "POST",
+			const resp = await fetch(trimUrl(_config.stateUrl) + '?store=' + encodeURIComponent(store), {
 				headers: {
-					"Content-Type": "application/json",
-					[_config.clientIdHeaderKey]: getClientId(
-						_config.clientIdHeaderKey
-					),
+					[_config.clientIdHeaderKey]: getClientId(_config.clientIdHeaderKey),
+					[_config.connectionIdHeaderKey]: _connectionId,
 				},
-				body: JSON.stringify(message),
-			}).then((resp) => resp.json());
+			});
+			if (!resp.ok) {
+				throw new Error('snapshot of ' + store + ' failed with status ' + resp.status);
+			}
+			return resp.json();
+		},
+		sendAction: async (message, options) => {
+			if (!_config) {
+				throw new Error("no config found");
+			}
+			message = { ...message, correlationId: message.correlationId ?? crypto.randomUUID() };
+			const updates = options?.awaitUpdates
+				? correlate(message.correlationId, options.timeout ?? 5000)
+				: null;
+			let response = null;
+			try {
+				response = _config.transport === 'websocket'
+					? await sendSocketAction(message, options?.actionTimeout ?? 30000)
+					: await postAction(message);
+			} catch (err) {
+				updates?.cancel();
+				throw err;
+			}
+			if (!updates) {
+				return response;
+			}
+			if (response.code !== 200) {
+				updates.cancel();
+				return { ...response, messages: [] };
+			}
+			return { ...response, messages: await updates.expect(response.updates ?? 0) };
 		}
 	};
 })();
@@ -160,20 +448,32 @@ func getJsScript() string {
 	return src
 }
 
-func getAppScript(config *Config, handlers []ActionHandler) string {
+// getAppScript writes the stores with the states of the client of the request, so the first
+// render shows the current data.
+func getAppScript(config *Config, handlers []ActionHandler, req *http.Request) string {
 	buf := bytes.NewBuffer([]byte{})
 	buf.WriteString(`{{ define "alpinejs_handler_stores" }}`)
 	buf.WriteString("<script>")
 	buf.WriteString(fmt.Sprintf(`window.alpinestorehandler.eventHandler.open({
+		clientId: '%s',
 		actionUrl: '%s',
 		eventUrl: '%s',
+		socketUrl: '%s',
+		pollUrl: '%s',
+		stateUrl: '%s',
+		stores: %s,
+		pollFallbackAfter: %v,
+		transport: '%s',
 		clientIdHeaderKey: '%s',
+		connectionIdHeaderKey: '%s',
 		reconnectTimeout: %v,
+		heartbeatInterval: %v,
 	});
-	`, config.ActionUrl, config.EventUrl, config.ClientIDHeaderKey, config.SocketReconnectInterval))
+	`, tools.GetClientId(req), config.ActionUrl, config.EventUrl, config.SocketUrl, config.PollUrl, config.StateUrl, storeNames(handlers), config.PollFallbackAfter, config.Transport, config.ClientIDHeaderKey, config.ConnectionIDHeaderKey, config.SocketReconnectInterval, config.HeartbeatInterval))
 	buf.WriteString("document.addEventListener('alpine:init', () => {")
 	for _, h := range handlers {
-		writeStore(buf, h.GetName(), parseDefaultState(h), h.GetActionType())
+		state, version := parseInitialState(h, req)
+		writeStore(buf, h.GetName(), state, version, h.GetActionType(), actionNames(h))
 	}
 	buf.WriteString("});")
 	buf.WriteString("</script>")
@@ -181,13 +481,59 @@ func getAppScript(config *Config, handlers []ActionHandler) string {
 	return buf.String()
 }
 
+func actionNames(handler ActionHandler) []string {
+	names := make([]string, 0)
+	ah, ok := handler.(actionsHandler)
+	_, stateful := handler.(statefulHandler)
+	if !ok || !stateful {
+		return names
+	}
+	for name := range ah.Actions() {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func storeNames(handlers []ActionHandler) string {
+	names := make([]string, 0, len(handlers))
+	for _, h := range handlers {
+		names = append(names, h.GetName())
+	}
+	stream, err := json.Marshal(names)
+	if err != nil {
+		return "[]"
+	}
+	return string(stream)
+}
+
+// parseInitialState returns the current state of the handler for the request, or the default
+// state when the handler has no state per client.
+func parseInitialState(handler ActionHandler, req *http.Request) (string, uint64) {
+	snapshot, err := actionProcessor.snapshot(handler.GetName(), req)
+	if err != nil {
+		return parseDefaultState(handler), 0
+	}
+	stream, err := json.Marshal(snapshot.State)
+	if err != nil {
+		return parseDefaultState(handler), 0
+	}
+	return escapeTemplateAction(string(stream)), snapshot.Version
+}
+
+// escapeTemplateAction escapes the delimiters of template actions in JSON strings, so
+// states with user data can not inject template actions into the page.
+func escapeTemplateAction(stream string) string {
+	return strings.ReplaceAll(stream, "{{", "{\\u007b")
+}
+
 func parseDefaultState(handler ActionHandler) string {
 	stream, err := json.Marshal(handler.GetDefaultState())
 	if err != nil {
 		println(fmt.Sprintf("error on get DefaultState of Handler %s: %s", handler.GetName(), err.Error()))
 		return "{}"
 	}
-	return string(stream)
+	return escapeTemplateAction(string(stream))
 }
 
 func headScripts() string {
@@ -196,27 +542,88 @@ func headScripts() string {
 	{{ end }}`
 }
 
-func writeStore(buf *bytes.Buffer, name, defaultState, actionType string) {
+func writeStore(buf *bytes.Buffer, name, initialState string, version uint64, actionType string, actions []string) {
+	methods := ""
+	for _, action := range actions {
+		methods += fmt.Sprintf(`
+				%[2]s(payload, options) {
+					return this.send('%[2]s', '[%[1]s] %[2]s', payload, options);
+				},`, name, action)
+	}
 	buf.WriteString(fmt.Sprintf(`
 			Alpine.store('%[1]s', {
 				state: %[2]v,
-				emit(payload) {
-					window.alpinestorehandler.eventHandler.sendAction({type:'%[3]s', payload});
+				version: %[4]d,
+				conflict: null,
+				canUndo: false,
+				canRedo: false,
+				pending: {%[5]s},
+				lastError: {%[6]s},
+				async send(action, type, payload, options) {
+					this.pending[action] = true;
+					try {
+						const response = await window.alpinestorehandler.eventHandler.sendAction({type, payload, version: this.version}, options);
+						this.conflict = response.code === 409 ? response : null;
+						this.lastError[action] = response.code === 200 ? null : response;
+						return response;
+					} catch (err) {
+						this.lastError[action] = { code: 0, error: err.message };
+						throw err;
+					} finally {
+						this.pending[action] = false;
+					}
+				},
+				emit(payload, options) {
+					return this.send('emit', '%[3]s', payload, options);
+				},
+				undo(options) {
+					return this.send('undo', '[%[1]s] undo', null, options);
 				},
-				update(state) {
+				redo(options) {
+					return this.send('redo', '[%[1]s] redo', null, options);
+				},%[7]s
+				update(state, version) {
 					window.alpinestorehandler.applyChanges(this.state, state);
+					this.version = version ?? this.version;
+					this.conflict = null;
+				},
+				patch(operations, version) {
+					window.alpinestorehandler.applyPatch(this.state, operations);
+					this.version = version ?? this.version;
+					this.conflict = null;
+				},
+				async refresh() {
+					const snapshot = await window.alpinestorehandler.eventHandler.snapshot('%[1]s');
+					this.update(snapshot.state, snapshot.version);
+					return snapshot;
 				}
 			});
-			window.alpinestorehandler.eventHandler.subscribe('[%[1]s] update', (payload) => {
-				Alpine.store('%[1]s').update(payload);
+			window.alpinestorehandler.eventHandler.subscribe('[%[1]s] update', (payload, message) => {
+				Alpine.store('%[1]s').update(payload, message?.version);
+			});
+			window.alpinestorehandler.eventHandler.subscribe('[%[1]s] patch', (payload, message) => {
+				Alpine.store('%[1]s').patch(payload, message?.version);
+			});
+			window.alpinestorehandler.eventHandler.subscribe('[%[1]s] history', (payload) => {
+				Alpine.store('%[1]s').canUndo = payload.canUndo;
+				Alpine.store('%[1]s').canRedo = payload.canRedo;
 			});
-		`, name, defaultState, actionType))
+		`, name, initialState, actionType, version, actionFlags(actions, "false"), actionFlags(actions, "null"), methods))
+}
+
+// actionFlags returns the object entries of a flag per store method, so Alpine tracks each of them.
+func actionFlags(actions []string, value string) string {
+	flags := make([]string, 0, len(actions)+3)
+	for _, action := range append([]string{"emit", "undo", "redo"}, actions...) {
+		flags = append(flags, fmt.Sprintf("%s: %s", action, value))
+	}
+	return strings.Join(flags, ", ")
 }
 
-func addScriptTemplates(tmpl *template.Template, config *Config, handlers []ActionHandler) *template.Template {
+func addScriptTemplates(tmpl *template.Template, config *Config, handlers []ActionHandler, req *http.Request) *template.Template {
 	t := template.Must(tmpl, nil)
 	t = template.Must(t.Parse(headScripts()))
 	t = template.Must(t.Parse(getJsScript()))
-	t = template.Must(t.Parse(getAppScript(config, handlers)))
+	t = template.Must(t.Parse(getAppScript(config, handlers, req)))
 	return t
 }
@@ -2,11 +2,14 @@ package goalpinejshandler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	di "github.com/nodejayes/generic-di"
@@ -14,9 +17,29 @@ import (
 
 const ContentTypeKey = "Content-Type"
 
+const heartbeatType = "heartbeat"
+
+const (
+	TransportSSE       Transport = "sse"
+	TransportWebSocket Transport = "websocket"
+	TransportPoll      Transport = "poll"
+)
+
+const (
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+	OverflowCoalesce   OverflowPolicy = "coalesce"
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
 var messagesPool = newMessagePool()
 var tools = &Tools{}
 
+type (
+	Transport      string
+	OverflowPolicy string
+)
+
 type (
 	Component interface {
 		Name() string
@@ -33,6 +56,31 @@ type (
 		GetDefaultState() any
 		Handle(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools)
 	}
+	// statefulHandler is an ActionHandler with one state per client ID. The framework creates the
+	// state with NewState, passes it to Handle through Tools.State and sends it to the client afterwards.
+	statefulHandler interface {
+		ActionHandler
+		NewState() any
+	}
+	// versionCheckedHandler is a statefulHandler that can reject actions whose version does not
+	// match the current version of the state.
+	versionCheckedHandler interface {
+		RejectStaleActions() bool
+	}
+	// historyHandler is a statefulHandler that keeps up to HistoryLimit previous states per scope.
+	// The client can step through them with the undo and redo actions of the store.
+	historyHandler interface {
+		HistoryLimit() int
+	}
+	// actionsHandler is a statefulHandler with named actions next to its action type.
+	actionsHandler interface {
+		Actions() map[string]Action
+	}
+	// resultHandler is an ActionHandler whose HandleResult runs instead of Handle. The result is
+	// sent back in the payload of the response, errors are answered with their status code.
+	resultHandler interface {
+		HandleResult(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools) (any, error)
+	}
 	protectedActionHandler interface {
 		ActionHandler
 		Authorized(msg Message, res http.ResponseWriter, req *http.Request, messagePool *MessagePool, tools *Tools) error
@@ -43,24 +91,107 @@ type (
 	Config struct {
 		EventUrl                string
 		ActionUrl               string
+		SocketUrl               string
+		PollUrl                 string
+		StateUrl                string
+		PollTimeout             int
+		PollFallbackAfter       int
+		Transport               Transport
 		ClientIDHeaderKey       string
+		ConnectionIDHeaderKey   string
+		UserIDResolver          func(req *http.Request) string
 		SocketReconnectInterval int
+		HeartbeatInterval       int
+		ReplayBufferSize        int
+		ReplayRetention         int
+		StateRetention          int
+		MaxClients              int
+		SendQueueSize           int
+		OverflowPolicy          OverflowPolicy
+		OnMessageDropped        func(client Client, msg ChannelMessage)
+		Broker                  Broker
+		StateStore              StateStore
+		Middleware              []Middleware
 		Pages                   []Page
 	}
 )
 
-func Register(router *http.ServeMux, config *Config) {
+// Register sets the defaults of the config and registers the pages, the stores of their handlers
+// and the endpoints of the JS client. It returns an error when the handlers are invalid.
+func Register(router *http.ServeMux, config *Config) error {
 	if config.SocketReconnectInterval < 1 {
 		config.SocketReconnectInterval = 5000
 	}
+	if config.HeartbeatInterval < 1 {
+		config.HeartbeatInterval = 15000
+	}
+	if config.ReplayBufferSize < 1 {
+		config.ReplayBufferSize = 100
+	}
+	if config.ReplayRetention < 1 {
+		config.ReplayRetention = 60000
+	}
+	if config.StateRetention < 1 {
+		config.StateRetention = 60000
+	}
+	if config.SendQueueSize < 1 {
+		config.SendQueueSize = 256
+	}
+	if config.OverflowPolicy == "" {
+		config.OverflowPolicy = OverflowDropOldest
+	}
+	if config.Broker == nil {
+		config.Broker = NewMemoryBroker()
+	}
+	if config.StateStore == nil {
+		config.StateStore = NewMemoryStateStore()
+	}
+	if config.ConnectionIDHeaderKey == "" {
+		config.ConnectionIDHeaderKey = "connectionId"
+	}
+	if config.Transport == "" {
+		config.Transport = TransportSSE
+	}
+	if config.SocketUrl == "" {
+		config.SocketUrl = "/socket"
+	}
+	if config.PollUrl == "" {
+		config.PollUrl = strings.TrimSuffix(config.EventUrl, "/") + "/poll"
+	}
+	if config.StateUrl == "" {
+		config.StateUrl = "/state"
+	}
+	if config.PollTimeout < 1 {
+		config.PollTimeout = 25000
+	}
+	if config.PollFallbackAfter < 1 {
+		config.PollFallbackAfter = 3
+	}
+	err := validateHandlers(config.Pages)
+	if err != nil {
+		return fmt.Errorf("invalid handlers: %w", err)
+	}
 	tools = newTools(config)
+	err = messagesPool.configure(config)
+	if err != nil {
+		return fmt.Errorf("error on subscribe to Broker: %w", err)
+	}
 	setupOutgoing(router, config)
 	setupIncoming(router, config)
+	setupPolling(router, config)
+	setupSnapshots(router, config)
+	if config.Transport == TransportWebSocket {
+		setupSocket(router, config)
+	}
+	di.Inject[stateManager]().configure(config)
+	di.Inject[clientTracker]().configure(config)
 	actionProcessor.registerTools(tools)
+	actionProcessor.registerMiddleware(config.Middleware)
 	for _, page := range config.Pages {
 		actionProcessor.registerHandlers(page.Handlers(), messagesPool)
 		router.HandleFunc(page.Route(), usePage(page, config))
 	}
+	return nil
 }
 
 func RegisterGlobalStyle(style string) {
@@ -80,7 +211,11 @@ func usePage(page Page, config *Config) http.HandlerFunc {
 			_, _ = w.Write([]byte{})
 			return
 		}
-		tmpl = addScriptTemplates(tmpl, config, page.Handlers())
+		clientID := readPageClientID(w, r, config)
+		di.Inject[clientTracker]().Touch(clientID)
+		r = r.Clone(r.Context())
+		r.Header.Set(config.ClientIDHeaderKey, clientID)
+		tmpl = addScriptTemplates(tmpl, config, page.Handlers(), r)
 		err = tmpl.ExecuteTemplate(buf, page.Name(), page)
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
@@ -103,74 +238,78 @@ func setupOutgoing(router *http.ServeMux, config *Config) {
 		res.Header().Set(ContentTypeKey, "text/event-stream")
 		res.Header().Set("Cache-Control", "no-cache")
 		res.Header().Set("Connection", "keep-alive")
-		connectionID := uuid.NewString()
+		connectionID := readConnectionID(req)
 
-		cls, clientID, failRegisterInClient := registerInClientStore(req, config, res, connectionID)
+		client, failRegisterInClient := registerInClientStore(req, config, res, connectionID)
 		if failRegisterInClient {
 			return
 		}
+		box := messagesPool.subscribe(client, readLastEventID(req))
+		defer unregisterFromClientStore(client)
 
-		requestClosed := false
-		closeLocker := &sync.Mutex{}
-		go func() {
-			<-req.Context().Done()
-			closeLocker.Lock()
-			requestClosed = true
-			clients := cls.Get(func(client Client) bool { return client.ConnectionID == connectionID })
-			if len(clients) > 0 {
-				for _, client := range clients {
-					cls.Remove(client)
-				}
-			}
-			clientIDClients := cls.Get(func(client Client) bool {
-				return client.ID == clientID
-			})
-			if len(clientIDClients) < 1 {
-				for _, page := range config.Pages {
-					for _, handler := range page.Handlers() {
-						dh, ok := handler.(destroyableHandler)
-						if ok {
-							dh.OnDestroy(clientID, tools)
-						}
-					}
-				}
-			}
-			closeLocker.Unlock()
-		}()
+		sendConnectedInfo(box, client)
+		sendSnapshots(box, client, req, config)
+		streamOutbox(req.Context(), client, box, config)
+	})
+}
 
-		sendConnectedInfo(clientID)
+// streamOutbox writes the queued messages of the connection and a heartbeat on every
+// HeartbeatInterval until the request ends, a write fails or the outbox is closed.
+func streamOutbox(ctx context.Context, client Client, box *outbox, config *Config) {
+	heartbeat := time.NewTicker(heartbeatInterval(config))
+	defer heartbeat.Stop()
 
-		for msg := range messagesPool.Pull() {
-			if requestClosed {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-box.done():
+			return
+		case <-heartbeat.C:
+			err := client.sendHeartbeat()
+			if err != nil {
 				return
 			}
-			client := cls.Get(msg.ClientFilter)
-			if len(client) < 1 {
-				continue
-			}
-			for _, c := range client {
-				c.SendMessage(msg)
+		case <-box.ready():
+			for _, msg := range box.drain() {
+				err := client.SendMessage(msg)
+				if err != nil {
+					return
+				}
 			}
 		}
+	}
+}
+
+func heartbeatInterval(config *Config) time.Duration {
+	return time.Duration(config.HeartbeatInterval) * time.Millisecond
+}
+
+func sendConnectedInfo(box *outbox, connected Client) {
+	box.push(ChannelMessage{
+		Message: Message{
+			Type:    "connected",
+			Payload: connected.ID,
+		},
+		ClientFilter: func(client Client) bool {
+			return client.ConnectionID == connected.ConnectionID
+		},
 	})
 }
 
-func sendConnectedInfo(clientID string) {
-	go func() {
-		messagesPool.Add(ChannelMessage{
-			Message: Message{
-				Type:    "connected",
-				Payload: clientID,
-			},
-			ClientFilter: func(client Client) bool {
-				return client.ID == clientID
-			},
-		})
-	}()
+func readLastEventID(req *http.Request) uint64 {
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = req.URL.Query().Get("lastEventId")
+	}
+	id, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
 }
 
-func registerInClientStore(req *http.Request, config *Config, res http.ResponseWriter, connectionID string) (*clientStore, string, bool) {
-	cls := di.Inject[clientStore]()
+func readClientID(req *http.Request, config *Config, res http.ResponseWriter) (string, bool) {
 	clientID := req.URL.Query().Get(config.ClientIDHeaderKey)
 	_, err := uuid.Parse(clientID)
 	if err != nil {
@@ -178,15 +317,70 @@ func registerInClientStore(req *http.Request, config *Config, res http.ResponseW
 			Code:  http.StatusBadRequest,
 			Error: "clientId not found in header",
 		})
-		return nil, "", true
+		return "", true
 	}
-	cls.Add(Client{
+	return clientID, false
+}
+
+// readPageClientID returns the client ID of the cookie the JS client writes, so the page can be
+// rendered with the states of the client. A new client ID is set as cookie when there is none.
+func readPageClientID(res http.ResponseWriter, req *http.Request, config *Config) string {
+	cookie, err := req.Cookie(config.ClientIDHeaderKey)
+	if err == nil {
+		_, err = uuid.Parse(cookie.Value)
+		if err == nil {
+			return cookie.Value
+		}
+	}
+	clientID := uuid.NewString()
+	http.SetCookie(res, &http.Cookie{
+		Name:     config.ClientIDHeaderKey,
+		Value:    clientID,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return clientID
+}
+
+func registerInClientStore(req *http.Request, config *Config, res http.ResponseWriter, connectionID string) (Client, bool) {
+	clientID, failReadClientID := readClientID(req, config, res)
+	if failReadClientID {
+		return Client{}, true
+	}
+	client := Client{
 		ID:           clientID,
 		ConnectionID: connectionID,
+		UserID:       resolveUserID(req, config, clientID),
 		Response:     res,
 		Request:      req,
+		writeTimeout: heartbeatInterval(config),
+	}
+	registerClient(client)
+	return client, false
+}
+
+// registerClient adds the connection and keeps the state of the client while it is connected.
+func registerClient(client Client) {
+	di.Inject[clientStore]().Add(client)
+	di.Inject[clientTracker]().Connect(client)
+}
+
+func unregisterFromClientStore(client Client) {
+	messagesPool.unsubscribe(client)
+	remaining := di.Inject[clientStore]().Remove(client)
+	states := di.Inject[stateManager]()
+	states.DeleteKey(scopeKey(ScopeConnection, client.ConnectionID))
+	if !tools.HasUserConnections(client.UserID) {
+		states.DeleteKey(scopeKey(ScopeUser, client.UserID))
+	}
+	if remaining > 0 {
+		return
+	}
+	messagesPool.shareRoom(roomChange{
+		Op:       roomLeaveAll,
+		ClientID: client.ID,
 	})
-	return cls, clientID, false
+	di.Inject[clientTracker]().Disconnect(client.ID)
 }
 
 func setupIncoming(router *http.ServeMux, config *Config) {
@@ -194,23 +388,13 @@ func setupIncoming(router *http.ServeMux, config *Config) {
 		var msg Message
 		err := json.NewDecoder(req.Body).Decode(&msg)
 		if err != nil {
-			jsonResponse(res, http.StatusInternalServerError, Response{
-				Code:  http.StatusInternalServerError,
+			jsonResponse(res, http.StatusBadRequest, Response{
+				Code:  http.StatusBadRequest,
 				Error: err.Error(),
 			})
 			return
 		}
-		err = actionProcessor.dispatch(msg, res, req)
-		if err != nil {
-			jsonResponse(res, http.StatusInternalServerError, Response{
-				Code:  http.StatusInternalServerError,
-				Error: err.Error(),
-			})
-			return
-		}
-		jsonResponse(res, http.StatusOK, Response{
-			Code:  http.StatusOK,
-			Error: "",
-		})
+		response := actionProcessor.dispatch(msg, res, req)
+		jsonResponse(res, response.Code, response)
 	})
 }
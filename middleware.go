@@ -0,0 +1,87 @@
+package goalpinejshandler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type (
+	// ActionFunc runs an action. The error decides the status code of the response.
+	ActionFunc func(ctx *ActionContext) error
+	// Middleware wraps the dispatch of actions. Config.Middleware wraps every action, handlers
+	// with a Middleware method wrap their own actions inside of it.
+	// The Payload of a Message from a client is filled after the middleware, when the action runs,
+	// middleware reads it with Message.DecodePayload.
+	Middleware func(next ActionFunc) ActionFunc
+	// middlewareHandler is an ActionHandler with its own Middleware.
+	middlewareHandler interface {
+		Middleware() []Middleware
+	}
+)
+
+// chain wraps the action in the middlewares, the first middleware is the outermost.
+func chain(action ActionFunc, middlewares ...[]Middleware) ActionFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		for j := len(middlewares[i]) - 1; j >= 0; j-- {
+			action = middlewares[i][j](action)
+		}
+	}
+	return action
+}
+
+// Logging prints the action type, the client ID, the duration and the error of every action.
+func Logging() Middleware {
+	return func(next ActionFunc) ActionFunc {
+		return func(ctx *ActionContext) error {
+			start := time.Now()
+			err := next(ctx)
+			if err != nil {
+				println(fmt.Sprintf("action %s of client %s failed after %s: %s", ctx.Message.Type, ctx.ClientID(), time.Since(start), err.Error()))
+				return err
+			}
+			println(fmt.Sprintf("action %s of client %s done after %s", ctx.Message.Type, ctx.ClientID(), time.Since(start)))
+			return nil
+		}
+	}
+}
+
+// Timing reports the duration of every action, for example to a metrics collector.
+func Timing(report func(ctx *ActionContext, duration time.Duration)) Middleware {
+	return func(next ActionFunc) ActionFunc {
+		return func(ctx *ActionContext) error {
+			start := time.Now()
+			err := next(ctx)
+			report(ctx, time.Since(start))
+			return err
+		}
+	}
+}
+
+// Recover turns a panic of an action into an error with status 500, so the client gets a
+// response and the server keeps running.
+func Recover() Middleware {
+	return func(next ActionFunc) ActionFunc {
+		return func(ctx *ActionContext) (err error) {
+			defer func() {
+				recovered := recover()
+				if recovered != nil {
+					err = NewStatusError(http.StatusInternalServerError, fmt.Errorf("action %s panicked: %v", ctx.Message.Type, recovered))
+				}
+			}()
+			return next(ctx)
+		}
+	}
+}
+
+// WithValue stores the resolved value under the key in the context of the request. Handlers read it
+// with ActionContext.Value or the context of the request they get.
+func WithValue(key any, resolve func(ctx *ActionContext) any) Middleware {
+	return func(next ActionFunc) ActionFunc {
+		return func(ctx *ActionContext) error {
+			ctx.Request = ctx.Request.WithContext(context.WithValue(ctx.Request.Context(), key, resolve(ctx)))
+			return next(ctx)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package goalpinejshandler
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// PatchOperation is a single RFC 6902 JSON Patch operation.
+type PatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// diffJSON returns the operations that turn the JSON value from into to.
+// Both values have to be decoded JSON (maps, slices and scalars).
+func diffJSON(from, to any) []PatchOperation {
+	operations := make([]PatchOperation, 0)
+	return appendDiff(operations, "", from, to)
+}
+
+func appendDiff(operations []PatchOperation, path string, from, to any) []PatchOperation {
+	fromObject, fromIsObject := from.(map[string]any)
+	toObject, toIsObject := to.(map[string]any)
+	if fromIsObject && toIsObject {
+		keys := make([]string, 0, len(fromObject)+len(toObject))
+		for key := range fromObject {
+			keys = append(keys, key)
+		}
+		for key := range toObject {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range slices.Compact(keys) {
+			fromValue, inFrom := fromObject[key]
+			toValue, inTo := toObject[key]
+			keyPath := path + "/" + escapePointer(key)
+			switch {
+			case !inTo:
+				operations = append(operations, PatchOperation{Op: "remove", Path: keyPath})
+			case !inFrom:
+				operations = append(operations, PatchOperation{Op: "add", Path: keyPath, Value: toValue})
+			default:
+				operations = appendDiff(operations, keyPath, fromValue, toValue)
+			}
+		}
+		return operations
+	}
+	fromArray, fromIsArray := from.([]any)
+	toArray, toIsArray := to.([]any)
+	if fromIsArray && toIsArray {
+		shared := min(len(fromArray), len(toArray))
+		for i := 0; i < shared; i++ {
+			operations = appendDiff(operations, fmt.Sprintf("%s/%d", path, i), fromArray[i], toArray[i])
+		}
+		for i := shared; i < len(toArray); i++ {
+			operations = append(operations, PatchOperation{Op: "add", Path: fmt.Sprintf("%s/%d", path, i), Value: toArray[i]})
+		}
+		for i := len(fromArray) - 1; i >= shared; i-- {
+			operations = append(operations, PatchOperation{Op: "remove", Path: fmt.Sprintf("%s/%d", path, i)})
+		}
+		return operations
+	}
+	if !reflect.DeepEqual(from, to) {
+		operations = append(operations, PatchOperation{Op: "replace", Path: path, Value: to})
+	}
+	return operations
+}
+
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// normalizeJSON converts a value into its decoded JSON form so it can be diffed.
+func normalizeJSON(value any) (any, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var result any
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
@@ -0,0 +1,157 @@
+package goalpinejshandler
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// applyPatch applies the operations the way applyPatch of the JS client does.
+func applyPatch(t *testing.T, document any, operations []PatchOperation) any {
+	for _, operation := range operations {
+		if operation.Path == "" {
+			document = operation.Value
+			continue
+		}
+		keys := strings.Split(operation.Path[1:], "/")
+		for i, key := range keys {
+			keys[i] = strings.ReplaceAll(strings.ReplaceAll(key, "~1", "/"), "~0", "~")
+		}
+		document = applyOperation(t, document, keys, operation)
+	}
+	return document
+}
+
+func applyOperation(t *testing.T, parent any, keys []string, operation PatchOperation) any {
+	key := keys[0]
+	switch value := parent.(type) {
+	case map[string]any:
+		if len(keys) > 1 {
+			value[key] = applyOperation(t, value[key], keys[1:], operation)
+		} else if operation.Op == "remove" {
+			delete(value, key)
+		} else {
+			value[key] = operation.Value
+		}
+		return value
+	case []any:
+		index := len(value)
+		if key != "-" {
+			var err error
+			index, err = strconv.Atoi(key)
+			if err != nil {
+				t.Fatalf("invalid array index in %s", operation.Path)
+			}
+		}
+		switch {
+		case len(keys) > 1:
+			value[index] = applyOperation(t, value[index], keys[1:], operation)
+		case operation.Op == "add":
+			value = append(value[:index], append([]any{operation.Value}, value[index:]...)...)
+		case operation.Op == "remove":
+			value = append(value[:index], value[index+1:]...)
+		case operation.Op == "replace":
+			value[index] = operation.Value
+		}
+		return value
+	}
+	t.Fatalf("path %s does not exist", operation.Path)
+	return nil
+}
+
+func decodeTestJSON(t *testing.T, data string) any {
+	var value any
+	err := json.Unmarshal([]byte(data), &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestDiffJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		from       string
+		to         string
+		operations string
+	}{
+		{
+			name:       "equal values",
+			from:       `{"value":1,"items":[1,2]}`,
+			to:         `{"value":1,"items":[1,2]}`,
+			operations: `[]`,
+		},
+		{
+			name:       "scalar",
+			from:       `1`,
+			to:         `2`,
+			operations: `[{"op":"replace","path":"","value":2}]`,
+		},
+		{
+			name:       "object add and remove",
+			from:       `{"a":1,"b":2}`,
+			to:         `{"b":3,"c":4}`,
+			operations: `[{"op":"remove","path":"/a","value":null},{"op":"replace","path":"/b","value":3},{"op":"add","path":"/c","value":4}]`,
+		},
+		{
+			name:       "nested object",
+			from:       `{"user":{"name":"a","tags":{"x":true}}}`,
+			to:         `{"user":{"name":"b","tags":{}}}`,
+			operations: `[{"op":"replace","path":"/user/name","value":"b"},{"op":"remove","path":"/user/tags/x","value":null}]`,
+		},
+		{
+			name:       "growing array",
+			from:       `{"items":[1]}`,
+			to:         `{"items":[1,2,3]}`,
+			operations: `[{"op":"add","path":"/items/1","value":2},{"op":"add","path":"/items/2","value":3}]`,
+		},
+		{
+			name:       "shrinking array removes from the end",
+			from:       `{"items":[1,2,3,4]}`,
+			to:         `{"items":[5]}`,
+			operations: `[{"op":"replace","path":"/items/0","value":5},{"op":"remove","path":"/items/3","value":null},{"op":"remove","path":"/items/2","value":null},{"op":"remove","path":"/items/1","value":null}]`,
+		},
+		{
+			name:       "emptied array",
+			from:       `[{"id":1},{"id":2}]`,
+			to:         `[]`,
+			operations: `[{"op":"remove","path":"/1","value":null},{"op":"remove","path":"/0","value":null}]`,
+		},
+		{
+			name:       "objects in arrays",
+			from:       `{"history":[{"id":1,"counter":"a"},{"id":2,"counter":"b"}]}`,
+			to:         `{"history":[{"id":1,"counter":"c"}]}`,
+			operations: `[{"op":"replace","path":"/history/0/counter","value":"c"},{"op":"remove","path":"/history/1","value":null}]`,
+		},
+		{
+			name:       "escaped keys",
+			from:       `{"a/b":1,"c~d":2,"~1":3}`,
+			to:         `{"a/b":2,"e~/f":3}`,
+			operations: `[{"op":"replace","path":"/a~1b","value":2},{"op":"remove","path":"/c~0d","value":null},{"op":"add","path":"/e~0~1f","value":3},{"op":"remove","path":"/~01","value":null}]`,
+		},
+		{
+			name:       "changed type",
+			from:       `{"value":[1,2]}`,
+			to:         `{"value":{"a":1}}`,
+			operations: `[{"op":"replace","path":"/value","value":{"a":1}}]`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			operations := diffJSON(decodeTestJSON(t, test.from), decodeTestJSON(t, test.to))
+			data, err := json.Marshal(operations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.operations {
+				t.Fatalf("unexpected operations\n got: %s\nwant: %s", data, test.operations)
+			}
+			patched := applyPatch(t, decodeTestJSON(t, test.from), operations)
+			if !reflect.DeepEqual(patched, decodeTestJSON(t, test.to)) {
+				t.Fatalf("patched value %v is not %s", patched, test.to)
+			}
+		})
+	}
+}
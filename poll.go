@@ -0,0 +1,185 @@
+package goalpinejshandler
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	di "github.com/nodejayes/generic-di"
+)
+
+func init() {
+	di.Injectable(newPollStore)
+}
+
+type (
+	pollEvent struct {
+		ID      uint64  `json:"id"`
+		Message Message `json:"message"`
+	}
+	pollSession struct {
+		client Client
+		box    *outbox
+		expiry *time.Timer
+		active bool
+		// unconfirmed is set while the client has not confirmed the events of the last response
+		// with its lastEventId, lastSent is the highest ID in that response.
+		unconfirmed bool
+		lastSent    uint64
+		openedAt    uint64
+	}
+	pollStore struct {
+		m        *sync.Mutex
+		sessions map[string]*pollSession
+	}
+)
+
+func newPollStore() *pollStore {
+	return &pollStore{
+		m:        &sync.Mutex{},
+		sessions: make(map[string]*pollSession),
+	}
+}
+
+// Open returns the session of the connection and stops its expiry while a poll request waits on it.
+// A new session is registered like a stream connection when none exists. When the last response
+// did not reach the client, the missed messages are queued again.
+func (ctx *pollStore) Open(client Client, lastEventID uint64, config *Config) *pollSession {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	session := ctx.sessions[client.ConnectionID]
+	if session != nil {
+		session.expiry.Stop()
+		session.active = true
+		if session.unconfirmed && (session.lastSent == 0 || lastEventID < session.lastSent) {
+			messagesPool.resume(session.box, max(lastEventID, session.openedAt))
+		}
+		session.unconfirmed = false
+		return session
+	}
+	registerClient(client)
+	openedAt := lastEventID
+	if openedAt == 0 {
+		openedAt = messagesPool.sequence.Load()
+	}
+	box := messagesPool.subscribe(client, lastEventID)
+	sendConnectedInfo(box, client)
+	sendSnapshots(box, client, client.Request, config)
+	session = &pollSession{
+		client:   client,
+		box:      box,
+		active:   true,
+		openedAt: openedAt,
+	}
+	session.expiry = time.AfterFunc(pollExpiry(config), func() {
+		ctx.expire(session, config)
+	})
+	session.expiry.Stop()
+	ctx.sessions[client.ConnectionID] = session
+	return session
+}
+
+// Release starts the expiry of the session after a poll request finished with the events.
+func (ctx *pollStore) Release(session *pollSession, events []pollEvent, config *Config) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	session.active = false
+	session.expiry.Reset(pollExpiry(config))
+	if len(events) < 1 {
+		return
+	}
+	session.unconfirmed = true
+	session.lastSent = 0
+	for _, event := range events {
+		session.lastSent = max(session.lastSent, event.ID)
+	}
+}
+
+func (ctx *pollStore) Close(session *pollSession, config *Config) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	ctx.close(session, config)
+}
+
+func (ctx *pollStore) expire(session *pollSession, config *Config) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	if session.active {
+		return
+	}
+	ctx.close(session, config)
+}
+
+func (ctx *pollStore) close(session *pollSession, config *Config) {
+	if ctx.sessions[session.client.ConnectionID] != session {
+		return
+	}
+	session.expiry.Stop()
+	delete(ctx.sessions, session.client.ConnectionID)
+	unregisterFromClientStore(session.client)
+}
+
+// setupPolling registers the long-poll endpoint for clients that can not keep an event stream open.
+// A poll waits up to PollTimeout for messages. The connection stays registered between polls and
+// is removed when no poll arrives for twice the PollTimeout.
+func setupPolling(router *http.ServeMux, config *Config) {
+	router.HandleFunc(fmt.Sprintf("GET %s", config.PollUrl), func(res http.ResponseWriter, req *http.Request) {
+		clientID, failReadClientID := readClientID(req, config, res)
+		if failReadClientID {
+			return
+		}
+		connectionID := req.URL.Query().Get("connectionId")
+		_, err := uuid.Parse(connectionID)
+		if err != nil {
+			jsonResponse(res, http.StatusBadRequest, Response{
+				Code:  http.StatusBadRequest,
+				Error: "connectionId not found in query",
+			})
+			return
+		}
+		polls := di.Inject[pollStore]()
+		session := polls.Open(Client{
+			ID:           clientID,
+			ConnectionID: connectionID,
+			UserID:       resolveUserID(req, config, clientID),
+			Request:      req,
+		}, readLastEventID(req), config)
+
+		timeout := time.NewTimer(time.Duration(config.PollTimeout) * time.Millisecond)
+		defer timeout.Stop()
+		select {
+		case <-req.Context().Done():
+			// the response can not reach the client, the messages stay queued for the next poll
+			polls.Release(session, nil, config)
+			return
+		case <-timeout.C:
+		case <-session.box.ready():
+		case <-session.box.done():
+			polls.Close(session, config)
+			jsonResponse(res, http.StatusGone, Response{
+				Code:  http.StatusGone,
+				Error: "connection closed",
+			})
+			return
+		}
+		events := make([]pollEvent, 0)
+		for _, msg := range session.box.drain() {
+			events = append(events, pollEvent{
+				ID:      msg.id,
+				Message: msg.Message,
+			})
+		}
+		polls.Release(session, events, config)
+		jsonResponse(res, http.StatusOK, events)
+	})
+}
+
+func pollExpiry(config *Config) time.Duration {
+	return 2 * time.Duration(config.PollTimeout) * time.Millisecond
+}
@@ -1,25 +1,478 @@
 package goalpinejshandler
 
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	di "github.com/nodejayes/generic-di"
+)
+
 type (
 	MessagePool struct {
-		messages chan ChannelMessage
+		m               *sync.Mutex
+		sequence        *atomic.Uint64
+		clients         map[string]*poolClient
+		connections     map[string]*outbox
+		replaySize      int
+		replayRetention time.Duration
+		queueSize       int
+		overflowPolicy  OverflowPolicy
+		onDropped       func(client Client, msg ChannelMessage)
+		broker          Broker
+		instanceID      string
+		correlation     *correlation
+	}
+	correlation struct {
+		id     string
+		caller Client
+		count  *atomic.Int64
 	}
+	// ChannelMessage is sent to the recipients described by Target. ClientFilter is used
+	// when no Target is set; it scans every client and only reaches clients of this instance.
 	ChannelMessage struct {
 		ClientFilter func(client Client) bool
+		Target       *Target
 		Message      Message
+		id           uint64
+		store        string
+	}
+	poolClient struct {
+		connections    map[string]*outbox
+		replay         []ChannelMessage
+		disconnectedAt time.Time
+	}
+	outbox struct {
+		m         *sync.Mutex
+		client    Client
+		messages  []ChannelMessage
+		signal    chan struct{}
+		closed    chan struct{}
+		size      int
+		policy    OverflowPolicy
+		onDropped func(client Client, msg ChannelMessage)
+		sent      map[string]any
 	}
 )
 
 func newMessagePool() *MessagePool {
 	return &MessagePool{
-		messages: make(chan ChannelMessage),
+		m:               &sync.Mutex{},
+		sequence:        &atomic.Uint64{},
+		clients:         make(map[string]*poolClient),
+		connections:     make(map[string]*outbox),
+		replaySize:      100,
+		replayRetention: time.Minute,
+		queueSize:       256,
+		overflowPolicy:  OverflowDropOldest,
+		instanceID:      uuid.NewString(),
 	}
 }
 
+// Add sends the message to its recipients. Messages with a Target are published through the
+// Broker and reach the clients of every instance, messages with only a ClientFilter are
+// delivered to the clients of this instance.
+// It does not wait for the connections to deliver the message.
 func (ctx *MessagePool) Add(msg ChannelMessage) {
-	ctx.messages <- msg
+	if ctx.correlation != nil && msg.Message.CorrelationID == "" {
+		msg.Message.CorrelationID = ctx.correlation.id
+		if msg.matches(ctx.correlation.caller) {
+			ctx.correlation.count.Add(1)
+		}
+	}
+	if msg.Target == nil {
+		ctx.deliver(msg)
+		return
+	}
+	data, err := json.Marshal(brokerEnvelope{
+		Target:  *msg.Target,
+		Message: msg.Message,
+		Store:   msg.store,
+	})
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	err = ctx.broker.Publish(data)
+	if err != nil {
+		fmt.Println(err.Error())
+		ctx.deliver(msg)
+	}
+}
+
+// correlate returns a view of the pool that stamps the correlation ID on every added message
+// and counts the messages that reach the calling connection.
+// The view shares the connections and settings of the pool.
+func (ctx *MessagePool) correlate(correlationID string, caller Client) *MessagePool {
+	if correlationID == "" {
+		return ctx
+	}
+	view := *ctx
+	view.correlation = &correlation{
+		id:     correlationID,
+		caller: caller,
+		count:  &atomic.Int64{},
+	}
+	return &view
+}
+
+// correlated returns the number of messages added through a correlated view that reach the caller.
+func (ctx *MessagePool) correlated() int {
+	if ctx.correlation == nil {
+		return 0
+	}
+	return int(ctx.correlation.count.Load())
+}
+
+// shareRoom applies the change of the room members on this instance and publishes it through
+// the Broker for the other instances.
+func (ctx *MessagePool) shareRoom(change roomChange) {
+	di.Inject[roomRegistry]().apply(change)
+	data, err := json.Marshal(brokerEnvelope{
+		Room:   &change,
+		Origin: ctx.instanceID,
+	})
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	err = ctx.broker.Publish(data)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+func (ctx *MessagePool) receive(data []byte) {
+	var envelope brokerEnvelope
+	err := json.Unmarshal(data, &envelope)
+	if err == nil && envelope.Room != nil {
+		if envelope.Origin != ctx.instanceID {
+			di.Inject[roomRegistry]().apply(*envelope.Room)
+		}
+		return
+	}
+	if err == nil {
+		err = envelope.Message.decodePayload()
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	ctx.deliver(ChannelMessage{
+		Target:  &envelope.Target,
+		Message: envelope.Message,
+		store:   envelope.Store,
+	})
+}
+
+// deliver queues the message for every connection of this instance that matches it.
+// Each message gets an ID and is kept in the replay buffer of every matching client ID,
+// so a client that reconnects can catch up on what it missed.
+func (ctx *MessagePool) deliver(msg ChannelMessage) {
+	if msg.ClientFilter == nil && msg.Target == nil {
+		return
+	}
+	msg.id = ctx.sequence.Add(1)
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	now := time.Now()
+	if msg.Target != nil {
+		clientIDs, indexed := ctx.recipients(msg.Target)
+		if indexed {
+			for _, clientID := range clientIDs {
+				pc := ctx.clients[clientID]
+				if pc != nil {
+					ctx.deliverTo(clientID, pc, msg, now)
+				}
+			}
+			return
+		}
+	}
+	for clientID, pc := range ctx.clients {
+		ctx.deliverTo(clientID, pc, msg, now)
+	}
+}
+
+// recipients looks up the client IDs a target can match in the client, connection and room indexes.
+// It returns false when the target needs a scan over all clients.
+func (ctx *MessagePool) recipients(target *Target) ([]string, bool) {
+	if target.All || len(target.UserIDs) > 0 {
+		return nil, false
+	}
+	result := slices.Clone(target.ClientIDs)
+	for _, connectionID := range target.ConnectionIDs {
+		box := ctx.connections[connectionID]
+		if box != nil {
+			result = append(result, box.client.ID)
+		}
+	}
+	if len(target.Rooms) > 0 {
+		result = append(result, di.Inject[roomRegistry]().Members(target.Rooms...)...)
+	}
+	slices.Sort(result)
+	return slices.Compact(result), true
+}
+
+func (ctx *MessagePool) deliverTo(clientID string, pc *poolClient, msg ChannelMessage, now time.Time) {
+	if len(pc.connections) < 1 && now.Sub(pc.disconnectedAt) > ctx.replayRetention {
+		delete(ctx.clients, clientID)
+		return
+	}
+	matched := false
+	for _, box := range pc.connections {
+		if msg.matches(box.client) {
+			box.push(msg)
+			matched = true
+		}
+	}
+	if len(pc.connections) < 1 {
+		matched = msg.matches(Client{ID: clientID})
+	}
+	if matched {
+		pc.remember(msg, ctx.replaySize)
+	}
+}
+
+func (ctx *MessagePool) configure(config *Config) error {
+	ctx.m.Lock()
+	ctx.broker = config.Broker
+	ctx.replaySize = config.ReplayBufferSize
+	ctx.replayRetention = time.Duration(config.ReplayRetention) * time.Millisecond
+	ctx.queueSize = config.SendQueueSize
+	ctx.overflowPolicy = config.OverflowPolicy
+	ctx.onDropped = config.OnMessageDropped
+	ctx.m.Unlock()
+
+	return ctx.broker.Subscribe(ctx.receive)
+}
+
+// subscribe opens an outbox for the connection. When lastEventID is set, the messages of the
+// client ID after that ID that match the connection are queued again.
+func (ctx *MessagePool) subscribe(client Client, lastEventID uint64) *outbox {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	pc := ctx.clients[client.ID]
+	if pc == nil {
+		pc = &poolClient{
+			connections: make(map[string]*outbox),
+			replay:      make([]ChannelMessage, 0),
+		}
+		ctx.clients[client.ID] = pc
+	}
+	box := newOutbox(client, ctx.queueSize, ctx.overflowPolicy, ctx.onDropped)
+	pc.connections[client.ConnectionID] = box
+	ctx.connections[client.ConnectionID] = box
+	if lastEventID > 0 {
+		for _, msg := range pc.replay {
+			if msg.id > lastEventID && msg.matches(client) {
+				box.push(msg)
+			}
+		}
+	}
+	return box
+}
+
+func (ctx *MessagePool) unsubscribe(client Client) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	box := ctx.connections[client.ConnectionID]
+	if box == nil || box.client != client {
+		// the connection ID was already taken over by a reconnect of the same page
+		return
+	}
+	delete(ctx.connections, client.ConnectionID)
+	pc := ctx.clients[client.ID]
+	if pc == nil {
+		return
+	}
+	delete(pc.connections, client.ConnectionID)
+	if len(pc.connections) < 1 {
+		pc.disconnectedAt = time.Now()
+	}
+}
+
+// resume queues the replayed messages of the client after lastEventID again that are no longer
+// in the outbox, and sends the next state of every store in full. It is used when a poll
+// response was lost, so the client neither misses messages nor patches a stale state.
+func (ctx *MessagePool) resume(box *outbox, lastEventID uint64) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	replay := make([]ChannelMessage, 0)
+	pc := ctx.clients[box.client.ID]
+	if pc != nil {
+		for _, msg := range pc.replay {
+			if msg.id > lastEventID && msg.matches(box.client) {
+				replay = append(replay, msg)
+			}
+		}
+	}
+	box.requeue(replay)
+}
+
+// forget drops the replay buffer of a client that has no connections left.
+func (ctx *MessagePool) forget(clientID string) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	pc := ctx.clients[clientID]
+	if pc != nil && len(pc.connections) < 1 {
+		delete(ctx.clients, clientID)
+	}
+}
+
+func (ctx *ChannelMessage) matches(client Client) bool {
+	if ctx.Target != nil {
+		return ctx.Target.Match(client)
+	}
+	return ctx.ClientFilter != nil && ctx.ClientFilter(client)
+}
+
+func (ctx *poolClient) remember(msg ChannelMessage, size int) {
+	ctx.replay = append(ctx.replay, msg)
+	if len(ctx.replay) > size {
+		ctx.replay = ctx.replay[len(ctx.replay)-size:]
+	}
+}
+
+func newOutbox(client Client, size int, policy OverflowPolicy, onDropped func(client Client, msg ChannelMessage)) *outbox {
+	return &outbox{
+		m:         &sync.Mutex{},
+		client:    client,
+		messages:  make([]ChannelMessage, 0),
+		signal:    make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+		size:      size,
+		policy:    policy,
+		onDropped: onDropped,
+		sent:      make(map[string]any),
+	}
+}
+
+// push queues the message. When the queue is full the overflow policy decides which
+// message is dropped, or closes the outbox when the policy is OverflowDisconnect.
+func (ctx *outbox) push(msg ChannelMessage) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	if ctx.isClosed() {
+		return
+	}
+	if len(ctx.messages) < ctx.size {
+		ctx.messages = append(ctx.messages, msg)
+		ctx.notify()
+		return
+	}
+	switch ctx.policy {
+	case OverflowDropNewest:
+		ctx.drop(msg)
+	case OverflowCoalesce:
+		idx := slices.IndexFunc(ctx.messages, func(queued ChannelMessage) bool {
+			return queued.Message.Type == msg.Message.Type
+		})
+		if idx < 0 {
+			idx = 0
+		}
+		ctx.drop(ctx.messages[idx])
+		ctx.messages = append(slices.Delete(ctx.messages, idx, idx+1), msg)
+	case OverflowDisconnect:
+		ctx.drop(msg)
+		close(ctx.closed)
+	default:
+		ctx.drop(ctx.messages[0])
+		ctx.messages = append(ctx.messages[1:], msg)
+	}
+	ctx.notify()
+}
+
+// requeue puts the messages that are not queued anymore in front of the queue and forgets the
+// states sent so far.
+func (ctx *outbox) requeue(messages []ChannelMessage) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	missing := slices.DeleteFunc(messages, func(msg ChannelMessage) bool {
+		return slices.ContainsFunc(ctx.messages, func(queued ChannelMessage) bool {
+			return queued.id == msg.id
+		})
+	})
+	ctx.messages = append(missing, ctx.messages...)
+	ctx.sent = make(map[string]any)
+	if len(ctx.messages) > 0 {
+		ctx.notify()
+	}
+}
+
+func (ctx *outbox) notify() {
+	select {
+	case ctx.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (ctx *outbox) drop(msg ChannelMessage) {
+	if ctx.onDropped != nil {
+		go ctx.onDropped(ctx.client, msg)
+	}
+}
+
+func (ctx *outbox) isClosed() bool {
+	select {
+	case <-ctx.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ctx *outbox) ready() <-chan struct{} {
+	return ctx.signal
 }
 
-func (ctx *MessagePool) Pull() chan ChannelMessage {
-	return ctx.messages
+func (ctx *outbox) done() <-chan struct{} {
+	return ctx.closed
+}
+
+// drain takes all queued messages. State updates of a store the connection already received
+// are replaced by a JSON Patch against the last state sent for that store.
+func (ctx *outbox) drain() []ChannelMessage {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	messages := ctx.messages
+	ctx.messages = make([]ChannelMessage, 0)
+	for i, msg := range messages {
+		if msg.store != "" {
+			messages[i] = ctx.diff(msg)
+		}
+	}
+	return messages
+}
+
+func (ctx *outbox) diff(msg ChannelMessage) ChannelMessage {
+	state, err := normalizeJSON(msg.Message.Payload)
+	if err != nil {
+		return msg
+	}
+	previous, ok := ctx.sent[msg.store]
+	ctx.sent[msg.store] = state
+	if !ok {
+		return msg
+	}
+	operations := diffJSON(previous, state)
+	full, _ := json.Marshal(state)
+	patch, _ := json.Marshal(operations)
+	if len(patch) >= len(full) {
+		return msg
+	}
+	msg.Message.Type = patchType(msg.store)
+	msg.Message.Payload = operations
+	return msg
 }
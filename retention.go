@@ -0,0 +1,189 @@
+package goalpinejshandler
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	di "github.com/nodejayes/generic-di"
+)
+
+func init() {
+	di.Injectable(newClientTracker)
+}
+
+type (
+	// clientTracker decides when the state of a client ID is evicted. A client is kept while it has
+	// connections and for StateRetention after its last connection closed, so a page reload finds its
+	// state again. With MaxClients set, the least recently used clients without connections are
+	// evicted first when more clients are tracked.
+	clientTracker struct {
+		m          *sync.Mutex
+		clients    map[string]*trackedClient
+		order      *list.List
+		retention  time.Duration
+		maxClients int
+		config     *Config
+	}
+	trackedClient struct {
+		id          string
+		connected   bool
+		element     *list.Element
+		expiry      *time.Timer
+		connections map[string]bool
+		users       map[string]bool
+	}
+)
+
+func newClientTracker() *clientTracker {
+	return &clientTracker{
+		m:         &sync.Mutex{},
+		clients:   make(map[string]*trackedClient),
+		order:     list.New(),
+		retention: time.Minute,
+	}
+}
+
+func (ctx *clientTracker) configure(config *Config) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	ctx.retention = time.Duration(config.StateRetention) * time.Millisecond
+	ctx.maxClients = config.MaxClients
+	ctx.config = config
+}
+
+// Touch marks the client as recently used. A client without connections keeps its state
+// for another StateRetention.
+func (ctx *clientTracker) Touch(clientID string) {
+	ctx.m.Lock()
+	tracked := ctx.track(clientID)
+	if !tracked.connected {
+		tracked.expiry.Reset(ctx.retention)
+	}
+	evicted := ctx.overflow()
+	ctx.m.Unlock()
+
+	ctx.evict(evicted)
+}
+
+// Connect stops the eviction of the client while it has connections. The connection and user ID
+// are remembered to delete their states with the client.
+func (ctx *clientTracker) Connect(client Client) {
+	ctx.m.Lock()
+	tracked := ctx.track(client.ID)
+	tracked.connected = true
+	tracked.connections[client.ConnectionID] = true
+	tracked.users[client.UserID] = true
+	tracked.expiry.Stop()
+	evicted := ctx.overflow()
+	ctx.m.Unlock()
+
+	ctx.evict(evicted)
+}
+
+// Disconnect starts the eviction of the client after its last connection closed.
+func (ctx *clientTracker) Disconnect(clientID string) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	tracked := ctx.track(clientID)
+	tracked.connected = false
+	tracked.expiry.Reset(ctx.retention)
+}
+
+func (ctx *clientTracker) track(clientID string) *trackedClient {
+	tracked := ctx.clients[clientID]
+	if tracked != nil {
+		ctx.order.MoveToFront(tracked.element)
+		return tracked
+	}
+	tracked = &trackedClient{
+		id:          clientID,
+		element:     ctx.order.PushFront(clientID),
+		connections: make(map[string]bool),
+		users:       make(map[string]bool),
+	}
+	tracked.expiry = time.AfterFunc(ctx.retention, func() {
+		ctx.expire(tracked)
+	})
+	ctx.clients[clientID] = tracked
+	return tracked
+}
+
+func (ctx *clientTracker) expire(tracked *trackedClient) {
+	ctx.m.Lock()
+	if tracked.connected || ctx.clients[tracked.id] != tracked {
+		ctx.m.Unlock()
+		return
+	}
+	ctx.remove(tracked)
+	ctx.m.Unlock()
+
+	ctx.evict([]*trackedClient{tracked})
+}
+
+// overflow removes the least recently used clients without connections above MaxClients
+// and returns them. Clients with connections are never evicted.
+func (ctx *clientTracker) overflow() []*trackedClient {
+	evicted := make([]*trackedClient, 0)
+	if ctx.maxClients < 1 {
+		return evicted
+	}
+	element := ctx.order.Back()
+	for len(ctx.clients) > ctx.maxClients && element != nil {
+		tracked := ctx.clients[element.Value.(string)]
+		element = element.Prev()
+		if tracked.connected {
+			continue
+		}
+		ctx.remove(tracked)
+		evicted = append(evicted, tracked)
+	}
+	return evicted
+}
+
+func (ctx *clientTracker) remove(tracked *trackedClient) {
+	tracked.expiry.Stop()
+	ctx.order.Remove(tracked.element)
+	delete(ctx.clients, tracked.id)
+}
+
+// evict calls OnDestroy of the handlers, deletes the states of the client, its connections and its
+// users without connections and drops its replay buffer. Rooms are left with the last connection
+// already; clients that joined a room without ever connecting leave it here, only on this instance,
+// because the client can have connections on another one.
+func (ctx *clientTracker) evict(evicted []*trackedClient) {
+	if len(evicted) < 1 {
+		return
+	}
+	ctx.m.Lock()
+	config := ctx.config
+	ctx.m.Unlock()
+
+	states := di.Inject[stateManager]()
+	for _, tracked := range evicted {
+		clientID := tracked.id
+		di.Inject[roomRegistry]().LeaveAll(clientID)
+		if config != nil {
+			for _, page := range config.Pages {
+				for _, handler := range page.Handlers() {
+					dh, ok := handler.(destroyableHandler)
+					if ok {
+						dh.OnDestroy(clientID, tools)
+					}
+				}
+			}
+		}
+		states.Evict(clientID)
+		for connectionID := range tracked.connections {
+			states.Evict(scopeKey(ScopeConnection, connectionID))
+		}
+		for userID := range tracked.users {
+			if userID != "" && !tools.HasUserConnections(userID) {
+				states.Evict(scopeKey(ScopeUser, userID))
+			}
+		}
+		messagesPool.forget(clientID)
+	}
+}
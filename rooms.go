@@ -0,0 +1,133 @@
+package goalpinejshandler
+
+import (
+	"sync"
+
+	di "github.com/nodejayes/generic-di"
+)
+
+func init() {
+	di.Injectable(newRoomRegistry)
+}
+
+const (
+	roomJoin     = "join"
+	roomLeave    = "leave"
+	roomLeaveAll = "leaveAll"
+)
+
+type (
+	// roomRegistry holds the room members of every instance. Changes are shared through the Broker
+	// with MessagePool.shareRoom, so ToRoom targets match on the instance of the connection.
+	roomRegistry struct {
+		m       *sync.Mutex
+		members map[string]map[string]bool
+		rooms   map[string]map[string]bool
+	}
+	// roomChange is a Join, Leave or LeaveAll published to the other instances.
+	roomChange struct {
+		Op       string `json:"op"`
+		ClientID string `json:"clientId"`
+		Room     string `json:"room,omitempty"`
+	}
+)
+
+func newRoomRegistry() *roomRegistry {
+	return &roomRegistry{
+		m:       &sync.Mutex{},
+		members: make(map[string]map[string]bool),
+		rooms:   make(map[string]map[string]bool),
+	}
+}
+
+func (ctx *roomRegistry) Join(clientID, room string) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	if ctx.members[room] == nil {
+		ctx.members[room] = make(map[string]bool)
+	}
+	if ctx.rooms[clientID] == nil {
+		ctx.rooms[clientID] = make(map[string]bool)
+	}
+	ctx.members[room][clientID] = true
+	ctx.rooms[clientID][room] = true
+}
+
+func (ctx *roomRegistry) Leave(clientID, room string) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	ctx.leave(clientID, room)
+}
+
+func (ctx *roomRegistry) LeaveAll(clientID string) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	for room := range ctx.rooms[clientID] {
+		ctx.leave(clientID, room)
+	}
+}
+
+func (ctx *roomRegistry) apply(change roomChange) {
+	switch change.Op {
+	case roomJoin:
+		ctx.Join(change.ClientID, change.Room)
+	case roomLeave:
+		ctx.Leave(change.ClientID, change.Room)
+	case roomLeaveAll:
+		ctx.LeaveAll(change.ClientID)
+	}
+}
+
+func (ctx *roomRegistry) Members(rooms ...string) []string {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, room := range rooms {
+		for clientID := range ctx.members[room] {
+			if !seen[clientID] {
+				seen[clientID] = true
+				result = append(result, clientID)
+			}
+		}
+	}
+	return result
+}
+
+func (ctx *roomRegistry) Rooms(clientID string) []string {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	result := make([]string, 0, len(ctx.rooms[clientID]))
+	for room := range ctx.rooms[clientID] {
+		result = append(result, room)
+	}
+	return result
+}
+
+func (ctx *roomRegistry) InAny(clientID string, rooms []string) bool {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	for _, room := range rooms {
+		if ctx.members[room][clientID] {
+			return true
+		}
+	}
+	return false
+}
+
+func (ctx *roomRegistry) leave(clientID, room string) {
+	delete(ctx.members[room], clientID)
+	if len(ctx.members[room]) < 1 {
+		delete(ctx.members, room)
+	}
+	delete(ctx.rooms[clientID], room)
+	if len(ctx.rooms[clientID]) < 1 {
+		delete(ctx.rooms, clientID)
+	}
+}
@@ -0,0 +1,87 @@
+package goalpinejshandler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ScopeGlobal     Scope = "global"
+	ScopeUser       Scope = "user"
+	ScopeClient     Scope = "client"
+	ScopeConnection Scope = "connection"
+)
+
+type (
+	// Scope decides which state a stateful handler works on and who receives its updates.
+	// ScopeGlobal shares one state with everyone, ScopeUser one state per user ID,
+	// ScopeClient one state per client ID (all tabs of a browser) and ScopeConnection
+	// one state per event stream.
+	Scope string
+	// scopedHandler is a statefulHandler that declares its Scope. Handlers without it use ScopeClient.
+	scopedHandler interface {
+		Scope() Scope
+	}
+)
+
+func handlerScope(handler ActionHandler) Scope {
+	sh, ok := handler.(scopedHandler)
+	if !ok || sh.Scope() == "" {
+		return ScopeClient
+	}
+	return sh.Scope()
+}
+
+// stateKey returns the key of the state and the recipients of its updates for the scope.
+func stateKey(scope Scope, tools *Tools, req *http.Request) (string, *Target, error) {
+	switch scope {
+	case ScopeGlobal:
+		return "global", ToAll(), nil
+	case ScopeUser:
+		userID := tools.GetUserId(req)
+		if userID == "" {
+			return "", nil, fmt.Errorf("userId not found for request")
+		}
+		return scopeKey(ScopeUser, userID), ToUser(userID), nil
+	case ScopeConnection:
+		connectionID := tools.GetConnectionId(req)
+		if connectionID == "" {
+			return "", nil, fmt.Errorf("connectionId not found in header")
+		}
+		return scopeKey(ScopeConnection, connectionID), ToConnection(connectionID), nil
+	}
+	clientID := tools.GetClientId(req)
+	if clientID == "" {
+		return "", nil, fmt.Errorf("clientId not found in header")
+	}
+	return clientID, ToClient(clientID), nil
+}
+
+func scopeKey(scope Scope, id string) string {
+	return fmt.Sprintf("%s:%s", scope, id)
+}
+
+// readConnectionID returns the connection ID the JS client sent with the stream request,
+// or a new one when it is missing.
+func readConnectionID(req *http.Request) string {
+	connectionID := req.URL.Query().Get("connectionId")
+	_, err := uuid.Parse(connectionID)
+	if err != nil {
+		return uuid.NewString()
+	}
+	return connectionID
+}
+
+// resolveUserID returns the user ID of Config.UserIDResolver, or the client ID when there is none.
+func resolveUserID(req *http.Request, config *Config, clientID string) string {
+	if config.UserIDResolver == nil {
+		return clientID
+	}
+	userID := config.UserIDResolver(req)
+	if userID == "" {
+		return clientID
+	}
+	return userID
+}
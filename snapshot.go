@@ -0,0 +1,111 @@
+package goalpinejshandler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	di "github.com/nodejayes/generic-di"
+)
+
+// Snapshot is the current state of a store for the requesting client.
+type Snapshot struct {
+	Store   string `json:"store"`
+	Version uint64 `json:"version"`
+	State   any    `json:"state"`
+}
+
+// snapshot returns the state of the store in the scope of the request.
+func (ctx *processor) snapshot(name string, req *http.Request) (Snapshot, error) {
+	handler := ctx.stores[name]
+	if handler != nil {
+		key, _, err := stateKey(handlerScope(handler), ctx.tools, req)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		entry := di.Inject[stateManager]().Get(handler, key)
+		entry.m.Lock()
+		defer entry.m.Unlock()
+
+		state, err := normalizeJSON(entry.state)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		return Snapshot{
+			Store:   name,
+			Version: entry.version,
+			State:   state,
+		}, nil
+	}
+	for _, derived := range ctx.derived {
+		if derived.GetName() != name {
+			continue
+		}
+		state, err := derived.state(ctx.stores, ctx.tools, req)
+		if err != nil {
+			return Snapshot{}, err
+		}
+		return Snapshot{
+			Store: name,
+			State: state,
+		}, nil
+	}
+	return Snapshot{}, fmt.Errorf("store %s not found", name)
+}
+
+// sendSnapshots queues the current state of every store the JS client listed in the stores
+// query parameter, so a new or reconnected connection is in sync without asking for it.
+func sendSnapshots(box *outbox, client Client, req *http.Request, config *Config) {
+	stores := req.URL.Query().Get("stores")
+	if stores == "" {
+		return
+	}
+	req = withClientHeaders(req, client, config)
+	for _, name := range strings.Split(stores, ",") {
+		snapshot, err := actionProcessor.snapshot(name, req)
+		if err != nil {
+			continue
+		}
+		box.push(ChannelMessage{
+			Message: Message{
+				Type:    updateType(name),
+				Payload: snapshot.State,
+				Version: snapshot.Version,
+			},
+			store: name,
+		})
+		history, ok := actionProcessor.historySnapshot(name, req)
+		if ok {
+			box.push(ChannelMessage{
+				Message: Message{
+					Type:    historyType(name),
+					Payload: history,
+				},
+			})
+		}
+	}
+}
+
+// setupSnapshots registers the endpoint that returns the Snapshot of the store query parameter.
+func setupSnapshots(router *http.ServeMux, config *Config) {
+	router.HandleFunc(fmt.Sprintf("GET %s", config.StateUrl), func(res http.ResponseWriter, req *http.Request) {
+		snapshot, err := actionProcessor.snapshot(req.URL.Query().Get("store"), req)
+		if err != nil {
+			jsonResponse(res, http.StatusNotFound, Response{
+				Code:  http.StatusNotFound,
+				Error: err.Error(),
+			})
+			return
+		}
+		jsonResponse(res, http.StatusOK, snapshot)
+	})
+}
+
+// withClientHeaders returns a copy of the request that carries the client and connection ID
+// in the headers, like the requests of actions do.
+func withClientHeaders(req *http.Request, client Client, config *Config) *http.Request {
+	req = req.Clone(req.Context())
+	req.Header.Set(config.ClientIDHeaderKey, client.ID)
+	req.Header.Set(config.ConnectionIDHeaderKey, client.ConnectionID)
+	return req
+}
@@ -0,0 +1,118 @@
+package goalpinejshandler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const socketReplyType = "reply"
+
+var upgrader = websocket.Upgrader{}
+
+type (
+	socketConnection struct {
+		m    *sync.Mutex
+		conn *websocket.Conn
+	}
+	socketAction struct {
+		ID      int     `json:"id"`
+		Message Message `json:"message"`
+	}
+	socketReply struct {
+		ID       int      `json:"id"`
+		Response Response `json:"response"`
+	}
+	socketResponseWriter struct {
+		header http.Header
+	}
+)
+
+func newSocketConnection(conn *websocket.Conn) *socketConnection {
+	return &socketConnection{
+		m:    &sync.Mutex{},
+		conn: conn,
+	}
+}
+
+func (ctx *socketConnection) write(msg Message, timeout time.Duration) error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	if timeout > 0 {
+		_ = ctx.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return ctx.conn.WriteJSON(msg)
+}
+
+func (ctx *socketResponseWriter) Header() http.Header {
+	return ctx.header
+}
+
+func (ctx *socketResponseWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (ctx *socketResponseWriter) WriteHeader(int) {}
+
+func setupSocket(router *http.ServeMux, config *Config) {
+	router.HandleFunc(fmt.Sprintf("GET %s", config.SocketUrl), func(res http.ResponseWriter, req *http.Request) {
+		clientID, failReadClientID := readClientID(req, config, res)
+		if failReadClientID {
+			return
+		}
+		conn, err := upgrader.Upgrade(res, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		socket := newSocketConnection(conn)
+		client := Client{
+			ID:           clientID,
+			ConnectionID: readConnectionID(req),
+			UserID:       resolveUserID(req, config, clientID),
+			Request:      req,
+			socket:       socket,
+			writeTimeout: heartbeatInterval(config),
+		}
+		registerClient(client)
+		box := messagesPool.subscribe(client, 0)
+		defer unregisterFromClientStore(client)
+
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		go readSocketActions(ctx, cancel, socket, client, config)
+
+		sendConnectedInfo(box, client)
+		sendSnapshots(box, client, req, config)
+		streamOutbox(ctx, client, box, config)
+	})
+}
+
+func readSocketActions(ctx context.Context, cancel context.CancelFunc, socket *socketConnection, client Client, config *Config) {
+	defer cancel()
+	for {
+		var action socketAction
+		err := socket.conn.ReadJSON(&action)
+		if err != nil {
+			return
+		}
+		req := withClientHeaders(client.Request.WithContext(ctx), client, config)
+		response := actionProcessor.dispatch(action.Message, &socketResponseWriter{header: make(http.Header)}, req)
+		err = socket.write(Message{
+			Type: socketReplyType,
+			Payload: socketReply{
+				ID:       action.ID,
+				Response: response,
+			},
+		}, client.writeTimeout)
+		if err != nil {
+			return
+		}
+	}
+}
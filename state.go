@@ -0,0 +1,133 @@
+package goalpinejshandler
+
+import (
+	"fmt"
+	"sync"
+
+	di "github.com/nodejayes/generic-di"
+)
+
+func init() {
+	di.Injectable(newStateManager)
+}
+
+type (
+	stateEntry struct {
+		m       *sync.Mutex
+		state   any
+		version uint64
+		past    []any
+		future  []any
+	}
+	storedState struct {
+		Version uint64 `json:"version"`
+		State   any    `json:"state"`
+	}
+	// ConflictError is returned when an action was based on an outdated version of the store state.
+	ConflictError struct {
+		Store   string
+		Version uint64
+		Current uint64
+	}
+	stateManager struct {
+		m       *sync.Mutex
+		entries map[string]map[string]*stateEntry
+		store   StateStore
+	}
+)
+
+func newStateManager() *stateManager {
+	return &stateManager{
+		m:       &sync.Mutex{},
+		entries: make(map[string]map[string]*stateEntry),
+		store:   NewMemoryStateStore(),
+	}
+}
+
+func (ctx *stateManager) configure(config *Config) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	ctx.store = config.StateStore
+}
+
+// Get returns the state of the handler for the key. On first use it is loaded from the StateStore,
+// or created with NewState when the store has nothing saved.
+func (ctx *stateManager) Get(handler statefulHandler, key string) *stateEntry {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	name := handler.GetName()
+	if ctx.entries[name] == nil {
+		ctx.entries[name] = make(map[string]*stateEntry)
+	}
+	entry := ctx.entries[name][key]
+	if entry == nil {
+		stored := storedState{State: handler.NewState()}
+		_, err := ctx.store.Load(name, key, &stored)
+		if err != nil {
+			println(fmt.Sprintf("error on load State of Handler %s: %s", name, err.Error()))
+			stored = storedState{State: handler.NewState()}
+		}
+		entry = &stateEntry{
+			m:       &sync.Mutex{},
+			state:   stored.State,
+			version: stored.Version,
+		}
+		ctx.entries[name][key] = entry
+	}
+	return entry
+}
+
+// Save writes the state of the entry to the StateStore. The caller holds the lock of the entry.
+func (ctx *stateManager) Save(handler statefulHandler, key string, entry *stateEntry) {
+	err := ctx.store.Save(handler.GetName(), key, storedState{
+		Version: entry.version,
+		State:   entry.state,
+	})
+	if err != nil {
+		println(fmt.Sprintf("error on save State of Handler %s: %s", handler.GetName(), err.Error()))
+	}
+}
+
+// DeleteKey unloads the states of all handlers for the key. The saved states stay in the StateStore.
+func (ctx *stateManager) DeleteKey(key string) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	for _, entries := range ctx.entries {
+		delete(entries, key)
+	}
+}
+
+// Evict unloads the states of all handlers for the key and deletes them from the StateStore,
+// unless the StateStore is persistent and keeps the states of evicted clients.
+func (ctx *stateManager) Evict(key string) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	ps, ok := ctx.store.(persistentStateStore)
+	keep := ok && ps.Persistent()
+	for name, entries := range ctx.entries {
+		delete(entries, key)
+		if keep {
+			continue
+		}
+		err := ctx.store.Delete(name, key)
+		if err != nil {
+			println(fmt.Sprintf("error on delete State of Handler %s: %s", name, err.Error()))
+		}
+	}
+}
+
+func (ctx *ConflictError) Error() string {
+	return fmt.Sprintf("state of %s changed: action is based on version %v, current version is %v", ctx.Store, ctx.Version, ctx.Current)
+}
+
+func updateType(name string) string {
+	return fmt.Sprintf("[%s] update", name)
+}
+
+func patchType(name string) string {
+	return fmt.Sprintf("[%s] patch", name)
+}
@@ -0,0 +1,69 @@
+package goalpinejshandler
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+type (
+	// StateStore persists the state of stateful handlers. Load decodes the saved state into the
+	// state argument and reports false when nothing was saved for the store and key.
+	StateStore interface {
+		Load(store, key string, state any) (bool, error)
+		Save(store, key string, state any) error
+		Delete(store, key string) error
+	}
+	// persistentStateStore is a StateStore that keeps the states of evicted clients, so they survive
+	// as long as the store does. Other stores delete them when a client is evicted.
+	persistentStateStore interface {
+		Persistent() bool
+	}
+	MemoryStateStore struct {
+		m      *sync.Mutex
+		states map[string]map[string][]byte
+	}
+)
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		m:      &sync.Mutex{},
+		states: make(map[string]map[string][]byte),
+	}
+}
+
+func (ctx *MemoryStateStore) Load(store, key string, state any) (bool, error) {
+	ctx.m.Lock()
+	data, ok := ctx.states[store][key]
+	ctx.m.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, state)
+}
+
+func (ctx *MemoryStateStore) Save(store, key string, state any) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	if ctx.states[store] == nil {
+		ctx.states[store] = make(map[string][]byte)
+	}
+	ctx.states[store][key] = data
+	return nil
+}
+
+func (ctx *MemoryStateStore) Delete(store, key string) error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	delete(ctx.states[store], key)
+	if len(ctx.states[store]) < 1 {
+		delete(ctx.states, store)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package goalpinejshandler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileStateStore saves every state as a JSON file at <directory>/<store>/<key>.json.
+type FileStateStore struct {
+	m         *sync.Mutex
+	directory string
+}
+
+func NewFileStateStore(directory string) *FileStateStore {
+	return &FileStateStore{
+		m:         &sync.Mutex{},
+		directory: directory,
+	}
+}
+
+func (ctx *FileStateStore) Load(store, key string, state any) (bool, error) {
+	ctx.m.Lock()
+	data, err := os.ReadFile(ctx.path(store, key))
+	ctx.m.Unlock()
+
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, state)
+}
+
+func (ctx *FileStateStore) Save(store, key string, state any) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	path := ctx.path(store, key)
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (ctx *FileStateStore) Delete(store, key string) error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	err := os.Remove(ctx.path(store, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Persistent keeps the files of evicted clients.
+func (ctx *FileStateStore) Persistent() bool {
+	return true
+}
+
+func (ctx *FileStateStore) path(store, key string) string {
+	return filepath.Join(ctx.directory, escapeFileName(store), escapeFileName(key)+".json")
+}
+
+// escapeFileName keeps names like ".." from leaving the store directory.
+func escapeFileName(name string) string {
+	return strings.ReplaceAll(url.PathEscape(name), ".", "%2E")
+}
@@ -0,0 +1,58 @@
+package goalpinejshandler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStateStoreSavesLoadsAndDeletes(t *testing.T) {
+	store := NewFileStateStore(t.TempDir())
+	err := store.Save("counter", "a", storeTestState{Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state storeTestState
+	ok, err := store.Load("counter", "a", &state)
+	if err != nil || !ok || state.Value != 1 {
+		t.Fatalf("expected the saved state, got %v %v %v", ok, state, err)
+	}
+	err = store.Delete("counter", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = store.Load("counter", "a", &state)
+	if err != nil || ok {
+		t.Fatalf("deleted state was loaded, got %v %v", ok, err)
+	}
+	err = store.Delete("counter", "a")
+	if err != nil {
+		t.Fatalf("deleting a missing state failed: %s", err)
+	}
+}
+
+func TestFileStateStoreKeepsKeysInsideItsDirectory(t *testing.T) {
+	root := t.TempDir()
+	store := NewFileStateStore(filepath.Join(root, "states"))
+	keys := []string{"..", "../escaped", "a/b", "a.b", "a%2Eb"}
+	for i, key := range keys {
+		err := store.Save("..", key, storeTestState{Value: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, key := range keys {
+		var state storeTestState
+		ok, err := store.Load("..", key, &state)
+		if err != nil || !ok || state.Value != i {
+			t.Fatalf("expected state %d for key %q, got %v %v %v", i, key, ok, state, err)
+		}
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "states" {
+		t.Fatalf("files were written outside of the store directory: %v", entries)
+	}
+}
@@ -0,0 +1,204 @@
+package goalpinejshandler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+type (
+	// KeyValueStateStore is an embedded key-value store in a single append-only file.
+	// Every change is appended as a JSON line and the file is compacted when it holds
+	// more than twice as many records as live states.
+	KeyValueStateStore struct {
+		m       *sync.Mutex
+		path    string
+		file    *os.File
+		states  map[kvKey]json.RawMessage
+		records int
+	}
+	kvKey struct {
+		Store string
+		Key   string
+	}
+	kvRecord struct {
+		Store   string          `json:"store"`
+		Key     string          `json:"key"`
+		State   json.RawMessage `json:"state,omitempty"`
+		Deleted bool            `json:"deleted,omitempty"`
+	}
+)
+
+// NewKeyValueStateStore opens the store file at path and creates it when it does not exist.
+func NewKeyValueStateStore(path string) (*KeyValueStateStore, error) {
+	ctx := &KeyValueStateStore{
+		m:      &sync.Mutex{},
+		path:   path,
+		states: make(map[kvKey]json.RawMessage),
+	}
+	size, err := ctx.read()
+	if err != nil {
+		return nil, err
+	}
+	ctx.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// a torn write at the end of the file is cut off, so the next record starts on its own line
+	err = ctx.file.Truncate(size)
+	if err != nil {
+		_ = ctx.file.Close()
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func (ctx *KeyValueStateStore) Load(store, key string, state any) (bool, error) {
+	ctx.m.Lock()
+	data, ok := ctx.states[kvKey{Store: store, Key: key}]
+	ctx.m.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, state)
+}
+
+func (ctx *KeyValueStateStore) Save(store, key string, state any) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	err = ctx.append(kvRecord{Store: store, Key: key, State: data})
+	if err != nil {
+		return err
+	}
+	ctx.states[kvKey{Store: store, Key: key}] = data
+	return ctx.compact()
+}
+
+func (ctx *KeyValueStateStore) Delete(store, key string) error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	_, ok := ctx.states[kvKey{Store: store, Key: key}]
+	if !ok {
+		return nil
+	}
+	err := ctx.append(kvRecord{Store: store, Key: key, Deleted: true})
+	if err != nil {
+		return err
+	}
+	delete(ctx.states, kvKey{Store: store, Key: key})
+	return ctx.compact()
+}
+
+// Persistent keeps the states of evicted clients in the file.
+func (ctx *KeyValueStateStore) Persistent() bool {
+	return true
+}
+
+func (ctx *KeyValueStateStore) Close() error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
+	return ctx.file.Close()
+}
+
+// read loads the states of the file and returns the size of its complete lines.
+func (ctx *KeyValueStateStore) read() (int64, error) {
+	file, err := os.Open(ctx.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// a torn write at the end of the file loses only the last change
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += int64(len(line))
+		var record kvRecord
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			continue
+		}
+		ctx.records++
+		if record.Deleted {
+			delete(ctx.states, kvKey{Store: record.Store, Key: record.Key})
+			continue
+		}
+		ctx.states[kvKey{Store: record.Store, Key: record.Key}] = record.State
+	}
+}
+
+func (ctx *KeyValueStateStore) append(record kvRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = ctx.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	ctx.records++
+	return ctx.file.Sync()
+}
+
+// compact rewrites the file with only the live states once it grew too large.
+// The rewritten file is opened for appending before it replaces the old one, so the store keeps
+// a working file when any step fails.
+func (ctx *KeyValueStateStore) compact() error {
+	if ctx.records < 64 || ctx.records < 2*len(ctx.states) {
+		return nil
+	}
+	tmp := ctx.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for key, state := range ctx.states {
+		data, err := json.Marshal(kvRecord{Store: key.Store, Key: key.Key, State: state})
+		if err == nil {
+			_, err = writer.Write(append(data, '\n'))
+		}
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, ctx.path)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	_ = ctx.file.Close()
+	ctx.file = file
+	ctx.records = len(ctx.states)
+	return nil
+}
@@ -0,0 +1,167 @@
+package goalpinejshandler
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type storeTestState struct {
+	Value int `json:"value"`
+}
+
+func openKeyValueStateStore(t *testing.T, path string) *KeyValueStateStore {
+	store, err := NewKeyValueStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	return store
+}
+
+func loadKeyValueState(t *testing.T, store *KeyValueStateStore, name, key string) (storeTestState, bool) {
+	var state storeTestState
+	ok, err := store.Load(name, key, &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, ok
+}
+
+func TestKeyValueStateStoreReopensSavedStates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "states.jsonl")
+	store := openKeyValueStateStore(t, path)
+	for key, value := range map[string]int{"a": 1, "b": 2, "c": 3} {
+		err := store.Save("counter", key, storeTestState{Value: value})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := store.Save("counter", "a", storeTestState{Value: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Delete("counter", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	reopened := openKeyValueStateStore(t, path)
+	state, ok := loadKeyValueState(t, reopened, "counter", "a")
+	if !ok || state.Value != 4 {
+		t.Fatalf("expected the last saved state of a, got %v %v", ok, state)
+	}
+	_, ok = loadKeyValueState(t, reopened, "counter", "b")
+	if ok {
+		t.Fatal("deleted state b was loaded")
+	}
+	state, ok = loadKeyValueState(t, reopened, "counter", "c")
+	if !ok || state.Value != 3 {
+		t.Fatalf("expected the saved state of c, got %v %v", ok, state)
+	}
+}
+
+func TestKeyValueStateStoreCompactsTheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "states.jsonl")
+	store := openKeyValueStateStore(t, path)
+	for i := 0; i < 200; i++ {
+		err := store.Save("counter", "a", storeTestState{Value: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Count(string(data), "\n")
+	if lines >= 64 {
+		t.Fatalf("file was not compacted, it has %d lines", lines)
+	}
+	err = store.Save("counter", "a", storeTestState{Value: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	reopened := openKeyValueStateStore(t, path)
+	state, ok := loadKeyValueState(t, reopened, "counter", "a")
+	if !ok || state.Value != 200 {
+		t.Fatalf("expected the state saved after compaction, got %v %v", ok, state)
+	}
+}
+
+func TestKeyValueStateStoreKeepsWorkingWhenCompactionFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "states.jsonl")
+	store := openKeyValueStateStore(t, path)
+	// a directory in place of the temporary file lets the compaction fail
+	err := os.Mkdir(path+".tmp", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := false
+	for i := 0; i < 64; i++ {
+		err = store.Save("counter", "a", storeTestState{Value: i})
+		if err != nil {
+			failed = true
+		}
+	}
+	if !failed {
+		t.Fatal("compaction did not fail")
+	}
+	err = os.Remove(path + ".tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Save("counter", "a", storeTestState{Value: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	reopened := openKeyValueStateStore(t, path)
+	state, ok := loadKeyValueState(t, reopened, "counter", "a")
+	if !ok || state.Value != 64 {
+		t.Fatalf("expected the state saved after the failed compaction, got %v %v", ok, state)
+	}
+}
+
+func TestKeyValueStateStoreSkipsATornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "states.jsonl")
+	store := openKeyValueStateStore(t, path)
+	err := store.Save("counter", "a", storeTestState{Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteString(`{"store":"counter","key":"a","sta`)
+	_ = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openKeyValueStateStore(t, path)
+	state, ok := loadKeyValueState(t, reopened, "counter", "a")
+	if !ok || state.Value != 1 {
+		t.Fatalf("expected the state before the torn line, got %v %v", ok, state)
+	}
+	err = reopened.Save("counter", "a", storeTestState{Value: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = reopened.Close()
+
+	again := openKeyValueStateStore(t, path)
+	state, ok = loadKeyValueState(t, again, "counter", "a")
+	if !ok || state.Value != 2 {
+		t.Fatalf("expected the state saved after the torn line, got %v %v", ok, state)
+	}
+}
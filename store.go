@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"slices"
 	"sync"
+	"time"
 
 	di "github.com/nodejayes/generic-di"
 )
@@ -18,8 +19,11 @@ type (
 	Client struct {
 		ID           string
 		ConnectionID string
+		UserID       string
 		Response     http.ResponseWriter
 		Request      *http.Request
+		socket       *socketConnection
+		writeTimeout time.Duration
 	}
 	clientStore struct {
 		m       *sync.Mutex
@@ -44,7 +48,8 @@ func (ctx *clientStore) Add(client Client) {
 	ctx.Clients[client.ID] = append(ctx.Clients[client.ID], client)
 }
 
-func (ctx *clientStore) Remove(client Client) {
+// Remove deletes the connection and returns the number of connections left for the client ID.
+func (ctx *clientStore) Remove(client Client) int {
 	ctx.m.Lock()
 	defer ctx.m.Unlock()
 
@@ -55,10 +60,15 @@ func (ctx *clientStore) Remove(client Client) {
 
 	if len(ctx.Clients[client.ID]) < 1 {
 		delete(ctx.Clients, client.ID)
+		return 0
 	}
+	return len(ctx.Clients[client.ID])
 }
 
 func (ctx *clientStore) Get(filter func(client Client) bool) []Client {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+
 	result := make([]Client, 0)
 	for _, cl := range ctx.Clients {
 		for _, c := range cl {
@@ -70,30 +80,49 @@ func (ctx *clientStore) Get(filter func(client Client) bool) []Client {
 	return result
 }
 
-func (ctx *Client) SendMessage(msg ChannelMessage) {
-	message, err := json.Marshal(msg.Message)
-	if err != nil {
-		return
+// SendMessage writes the message to the connection. An error means the connection is broken
+// and should be removed.
+func (ctx *Client) SendMessage(msg ChannelMessage) error {
+	return ctx.write(msg.id, msg.Message)
+}
+
+// sendHeartbeat writes an empty heartbeat message. It is sent as a regular message instead of an
+// SSE comment so the JS client can see it and detect a stalled stream.
+func (ctx *Client) sendHeartbeat() error {
+	return ctx.write(0, Message{Type: heartbeatType})
+}
+
+func (ctx *Client) write(id uint64, msg Message) error {
+	if ctx.socket != nil {
+		return ctx.socket.write(msg, ctx.writeTimeout)
 	}
-	data, err := formatMessage(string(message))
+	message, err := json.Marshal(msg)
 	if err != nil {
 		fmt.Println(err.Error())
-		return
+		return nil
 	}
-	_, err = ctx.Response.Write([]byte(data))
+	data, err := formatMessage(id, string(message))
 	if err != nil {
 		fmt.Println(err.Error())
-		return
+		return nil
 	}
 	rc := http.NewResponseController(ctx.Response)
+	if ctx.writeTimeout > 0 {
+		_ = rc.SetWriteDeadline(time.Now().Add(ctx.writeTimeout))
+	}
+	_, err = ctx.Response.Write([]byte(data))
+	if err != nil {
+		return err
+	}
 	err = rc.Flush()
 	if err != nil {
 		println(err.Error())
 		flusher, ok := ctx.Response.(http.Flusher)
 		if !ok {
 			println("flusher not supported")
-			return
+			return err
 		}
 		flusher.Flush()
 	}
+	return nil
 }
@@ -0,0 +1,80 @@
+package goalpinejshandler
+
+import (
+	"slices"
+
+	di "github.com/nodejayes/generic-di"
+)
+
+// Target describes the recipients of a ChannelMessage in a form that can be
+// serialized and evaluated on every instance. A client is a recipient when it matches
+// any of the fields and is not listed in ExceptClientIDs.
+type Target struct {
+	All             bool     `json:"all,omitempty"`
+	ClientIDs       []string `json:"clientIds,omitempty"`
+	ConnectionIDs   []string `json:"connectionIds,omitempty"`
+	UserIDs         []string `json:"userIds,omitempty"`
+	ExceptClientIDs []string `json:"exceptClientIds,omitempty"`
+	Rooms           []string `json:"rooms,omitempty"`
+}
+
+// ToAll targets every connected client.
+func ToAll() *Target {
+	return &Target{
+		All: true,
+	}
+}
+
+// ToClient targets every connection of the client ID.
+func ToClient(clientID string) *Target {
+	return ToClients(clientID)
+}
+
+// ToClients targets every connection of the client IDs.
+func ToClients(clientIDs ...string) *Target {
+	return &Target{
+		ClientIDs: clientIDs,
+	}
+}
+
+// ToConnection targets a single connection.
+func ToConnection(connectionID string) *Target {
+	return &Target{
+		ConnectionIDs: []string{connectionID},
+	}
+}
+
+// ToUser targets every connection of the user ID resolved by Config.UserIDResolver.
+func ToUser(userID string) *Target {
+	return &Target{
+		UserIDs: []string{userID},
+	}
+}
+
+// Except targets every connected client but the client IDs.
+func Except(clientIDs ...string) *Target {
+	return &Target{
+		All:             true,
+		ExceptClientIDs: clientIDs,
+	}
+}
+
+// ToRoom targets every client that joined one of the rooms. Tools.Join shares the members through
+// the Broker, so the instance of a connection knows its rooms.
+func ToRoom(rooms ...string) *Target {
+	return &Target{
+		Rooms: rooms,
+	}
+}
+
+// Match reports whether the client is a recipient of the target.
+func (ctx *Target) Match(client Client) bool {
+	if slices.Contains(ctx.ExceptClientIDs, client.ID) {
+		return false
+	}
+	return ctx.All ||
+		slices.Contains(ctx.ClientIDs, client.ID) ||
+		(client.ConnectionID != "" && slices.Contains(ctx.ConnectionIDs, client.ConnectionID)) ||
+		(client.UserID != "" && slices.Contains(ctx.UserIDs, client.UserID)) ||
+		(len(ctx.Rooms) > 0 && di.Inject[roomRegistry]().InAny(client.ID, ctx.Rooms))
+}
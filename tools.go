@@ -10,6 +10,7 @@ import (
 
 type Tools struct {
 	config *Config
+	state  any
 }
 
 func newTools(config *Config) *Tools {
@@ -22,6 +23,34 @@ func (ctx *Tools) GetClientId(req *http.Request) string {
 	return req.Header.Get(ctx.config.ClientIDHeaderKey)
 }
 
+// State returns the state of the calling client while a handler with NewState runs, otherwise nil.
+func (ctx *Tools) State() any {
+	return ctx.state
+}
+
+func (ctx *Tools) withState(state any) *Tools {
+	return &Tools{
+		config: ctx.config,
+		state:  state,
+	}
+}
+
+func (ctx *Tools) GetConnectionId(req *http.Request) string {
+	return req.Header.Get(ctx.config.ConnectionIDHeaderKey)
+}
+
+// GetUserId returns the user ID of Config.UserIDResolver, or the client ID when no resolver is set.
+func (ctx *Tools) GetUserId(req *http.Request) string {
+	return resolveUserID(req, ctx.config, ctx.GetClientId(req))
+}
+
+func (ctx *Tools) HasUserConnections(userID string) bool {
+	cls := di.Inject[clientStore]()
+	return len(cls.Get(func(client Client) bool {
+		return client.UserID == userID
+	})) > 0
+}
+
 func (ctx *Tools) HasConnections(clientID string) bool {
 	cls := di.Inject[clientStore]()
 	return len(cls.Get(func(client Client) bool {
@@ -29,6 +58,33 @@ func (ctx *Tools) HasConnections(clientID string) bool {
 	})) > 0
 }
 
+// Join adds the client to the room on every instance of the Broker. Messages with a ToRoom target
+// reach every connection of the client until it leaves the room or the last connection of an
+// instance closes.
+func (ctx *Tools) Join(clientID, room string) {
+	messagesPool.shareRoom(roomChange{
+		Op:       roomJoin,
+		ClientID: clientID,
+		Room:     room,
+	})
+}
+
+func (ctx *Tools) Leave(clientID, room string) {
+	messagesPool.shareRoom(roomChange{
+		Op:       roomLeave,
+		ClientID: clientID,
+		Room:     room,
+	})
+}
+
+func (ctx *Tools) Rooms(clientID string) []string {
+	return di.Inject[roomRegistry]().Rooms(clientID)
+}
+
+func (ctx *Tools) Members(room string) []string {
+	return di.Inject[roomRegistry]().Members(room)
+}
+
 func jsonResponse(res http.ResponseWriter, statusCode int, data any) {
 	res.Header().Set("Content-Type", "application/json")
 	res.WriteHeader(statusCode)
@@ -36,9 +92,12 @@ func jsonResponse(res http.ResponseWriter, statusCode int, data any) {
 	_, _ = res.Write(str)
 }
 
-func formatMessage(data string) (string, error) {
+func formatMessage(id uint64, data string) (string, error) {
 	sb := strings.Builder{}
 
+	if id > 0 {
+		sb.WriteString(fmt.Sprintf("id: %v\n", id))
+	}
 	sb.WriteString(fmt.Sprintf("data: %v\n", data))
 	sb.WriteString("\n")
 
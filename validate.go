@@ -0,0 +1,102 @@
+package goalpinejshandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+)
+
+var jsIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// storeMembers are the members of the generated Alpine store that named actions can not replace.
+var storeMembers = []string{"state", "version", "conflict", "canUndo", "canRedo", "pending", "lastError", "send", "emit", "undo", "redo", "update", "patch", "refresh"}
+
+// validateHandlers checks the handlers of all pages before they are registered. The same handler
+// may be used by several pages, but two handlers must not share a store name or an action type.
+func validateHandlers(pages []Page) error {
+	errs := make([]error, 0)
+	stores := make(map[string]ActionHandler)
+	actionTypes := make(map[string]ActionHandler)
+	claim := func(actionType string, handler ActionHandler) {
+		other, ok := actionTypes[actionType]
+		if ok {
+			errs = append(errs, fmt.Errorf("action type %s of store %s is already used by store %s", actionType, handler.GetName(), other.GetName()))
+			return
+		}
+		actionTypes[actionType] = handler
+	}
+	for _, page := range pages {
+		for _, handler := range page.Handlers() {
+			name := handler.GetName()
+			other, ok := stores[name]
+			if ok {
+				if !sameHandler(handler, other) {
+					errs = append(errs, fmt.Errorf("store %s of page %s is already registered by another handler", name, page.Name()))
+				}
+				continue
+			}
+			stores[name] = handler
+			if !jsIdentifier.MatchString(name) {
+				errs = append(errs, fmt.Errorf("store name %q of page %s is not a valid JS identifier", name, page.Name()))
+			}
+			claim(handler.GetActionType(), handler)
+			claim(updateType(name), handler)
+			claim(patchType(name), handler)
+			claim(historyType(name), handler)
+			if historyLimit(handler) > 0 {
+				claim(undoType(name), handler)
+				claim(redoType(name), handler)
+			}
+			ah, ok := handler.(actionsHandler)
+			_, stateful := handler.(statefulHandler)
+			if ok && !stateful && len(ah.Actions()) > 0 {
+				errs = append(errs, fmt.Errorf("store %s has named actions but no NewState, named actions need a stateful handler", name))
+			} else if ok {
+				for action := range ah.Actions() {
+					if !jsIdentifier.MatchString(action) || slices.Contains(storeMembers, action) {
+						errs = append(errs, fmt.Errorf("action name %q of store %s is not a valid JS identifier or a reserved store member", action, name))
+						continue
+					}
+					claim(namedActionType(name, action), handler)
+				}
+			}
+			_, derived := handler.(*DerivedStore)
+			if derived {
+				continue
+			}
+			_, err := json.Marshal(handler.GetDefaultState())
+			if err != nil {
+				errs = append(errs, fmt.Errorf("default state of store %s can not be marshaled: %w", name, err))
+			}
+		}
+	}
+	for name, handler := range stores {
+		derived, ok := handler.(*DerivedStore)
+		if !ok {
+			continue
+		}
+		for _, input := range derived.inputs {
+			_, stateful := stores[input].(statefulHandler)
+			if !stateful {
+				errs = append(errs, fmt.Errorf("input store %s of derived store %s not found", input, name))
+				continue
+			}
+			// a derived store is recomputed for the scope of the action that changed an input,
+			// so every input must have the scope of the derived store
+			if handlerScope(stores[input]) != handlerScope(derived) {
+				errs = append(errs, fmt.Errorf("derived store %s with scope %s can not read input store %s with scope %s", name, handlerScope(derived), input, handlerScope(stores[input])))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sameHandler reports whether both handlers are the same value, handlers that can not be
+// compared are always different.
+func sameHandler(a, b ActionHandler) bool {
+	typ := reflect.TypeOf(a)
+	return typ == reflect.TypeOf(b) && typ.Comparable() && a == b
+}